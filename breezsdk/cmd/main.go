@@ -4,10 +4,15 @@ import (
 	"context"
 	"log"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	firebase "firebase.google.com/go"
 	"github.com/Netflix/go-env"
 	"github.com/joho/godotenv"
+	"golang.org/x/exp/slog"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
 
@@ -15,8 +20,14 @@ import (
 	"github.com/breez/notify/channel"
 	"github.com/breez/notify/config"
 	"github.com/breez/notify/http"
+	"github.com/breez/notify/logging"
+	"github.com/breez/notify/notify"
+	"github.com/breez/notify/notify/services"
+	"github.com/breez/notify/notify/store"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
 	var err error
 	var firebaseApp *firebase.App
@@ -39,6 +50,18 @@ func main() {
 		log.Fatalf("failed to validate config %v", err)
 	}
 
+	redactKeys := append(append([]string{}, logging.DefaultRedactKeys...), config.RedactKeys()...)
+	logger, err := logging.New(os.Stdout, config.LogFormat, config.LogLevel, logging.NewRedactor(redactKeys...))
+	if err != nil {
+		log.Fatalf("failed to create logger %v", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := setupTracing(ctx, &config)
+	if err != nil {
+		log.Fatalf("failed to setup tracing %v", err)
+	}
+
 	if _, f := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS_JSON"); f {
 		creds, err := google.CredentialsFromJSON(context.Background(), []byte(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")), "https://www.googleapis.com/auth/firebase.messaging")
 		if err != nil {
@@ -60,12 +83,63 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to create firebase messaging %v", err)
 	}
-	notifier, err := breezsdk.NewNotifier(&config, fcmMessaging)
+	metrics := http.NewMetrics()
+	opts := []notify.Option{notify.WithLogger(logger), notify.WithMiddlewares(notify.Logging(), notify.Metrics(metrics))}
+	if config.StorePath != "" {
+		boltStore, err := store.NewBoltStore(config.StorePath)
+		if err != nil {
+			log.Fatalf("failed to open notification store %v", err)
+		}
+		defer boltStore.Close()
+		opts = append(opts, notify.WithStore(boltStore), notify.WithDeadLetterStore(boltStore), notify.WithDeliveryStore(boltStore), notify.WithScheduleStore(boltStore), notify.WithTokenBlocklist(boltStore))
+	} else {
+		memoryStore := store.NewMemoryStore()
+		opts = append(opts, notify.WithDeadLetterStore(memoryStore), notify.WithDeliveryStore(memoryStore), notify.WithTokenBlocklist(memoryStore))
+	}
+	var live *services.Live
+	httpOpts := []http.Option{http.WithMetrics(metrics), http.WithLogger(logger)}
+	if config.Live.Secret != "" {
+		live = services.NewLive(services.LiveConfig{
+			Secret:     []byte(config.Live.Secret),
+			BufferSize: config.Live.BufferSize,
+			BufferTTL:  config.Live.BufferTTL,
+		})
+		httpOpts = append(httpOpts, http.WithLive(live))
+	}
+	notifier, closeServices, err := breezsdk.NewNotifier(&config, fcmMessaging, live, opts...)
 	if err != nil {
 		log.Fatalf("failed to create breezsdk notifier %v", err)
 	}
-	channel := channel.NewHttpCallbackChannel(config.ExternalURL)
-	if err = http.Run(notifier, channel, &config.HTTPConfig); err != nil {
-		log.Printf("web server has exited with error")
+	channel := channel.NewHttpCallbackChannel(config.ExternalURL, channel.WithLogger(logger))
+
+	shutdownTimeout := config.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	// The notifier is drained by the web server before it closes the live
+	// connections, or here when the server failed to start.
+	var drainOnce sync.Once
+	drain := func() {
+		drainOnce.Do(func() {
+			if err := notifier.Shutdown(shutdownCtx); err != nil {
+				logger.Error("failed to drain notifications", "error", err)
+			}
+		})
+	}
+	httpOpts = append(httpOpts, http.WithDrain(drain))
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err = http.Run(ctx, notifier, channel, &config.HTTPConfig, httpOpts...); err != nil {
+		logger.Error("web server has exited", "error", err)
+	}
+
+	drain()
+	// The services are closed once nothing is sent through them anymore.
+	closeServices()
+	if err = shutdownTracing(shutdownCtx); err != nil {
+		logger.Error("failed to flush traces", "error", err)
 	}
 }
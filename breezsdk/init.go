@@ -3,6 +3,8 @@ package breezsdk
 import (
 	"encoding/json"
 	"fmt"
+	"os"
+	"time"
 
 	"firebase.google.com/go/messaging"
 	"github.com/breez/notify/config"
@@ -10,36 +12,268 @@ import (
 	"github.com/breez/notify/notify/services"
 )
 
-func NewNotifier(c *config.Config, fcmClient *messaging.Client) (*notify.Notifier, error) {
+const tokenWebhookTimeout = 10 * time.Second
+
+// NewNotifier returns the notifier of the breez sdk notifications, and the
+// function closing the connections of its services once it is shut down.
+// The live service, shared with the http server holding the connections, is
+// optional and closed by the server.
+func NewNotifier(c *config.Config, fcmClient *messaging.Client, live *services.Live, opts ...notify.Option) (*notify.Notifier, func(), error) {
 	fcm := services.NewFCM(createMessageFactory(), fcmClient)
-	return notify.NewNotifier(c, map[string]notify.Service{
+	serviceByType := map[string]notify.Service{
 		"ios":     fcm,
 		"android": fcm,
+	}
+	platforms := []string{"ios", "android"}
+	var closers []func()
+	if c.APNS.KeyPath != "" {
+		apns, err := newAPNS(&c.APNS)
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceByType["apns"] = apns
+		platforms = append(platforms, "apns")
+	}
+	if hosts := c.UnifiedPush.HostList(); len(hosts) > 0 {
+		unifiedPush, err := services.NewUnifiedPush(createUnifiedPushMessageFactory(), services.UnifiedPushConfig{Hosts: hosts})
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceByType["unifiedpush"] = unifiedPush
+		platforms = append(platforms, "unifiedpush")
+	}
+	if c.WebPush.VAPIDPrivateKey != "" {
+		webPush, err := services.NewWebPush(createWebPushMessageFactory(), services.WebPushConfig{
+			VAPIDPrivateKey: c.WebPush.VAPIDPrivateKey,
+			Subject:         c.WebPush.VAPIDSubject,
+			Hosts:           c.WebPush.HostList(),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceByType["web"] = webPush
+		platforms = append(platforms, "web")
+	}
+	if c.Webhook.TargetsPath != "" {
+		webhook, err := newWebhook(&c.Webhook)
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceByType["webhook"] = webhook
+		platforms = append(platforms, "webhook")
+	}
+	if c.Nostr.PrivateKey != "" {
+		nostr, err := services.NewNostr(createNostrMessageFactory(), services.NostrConfig{
+			PrivateKey: c.Nostr.PrivateKey,
+			Relays:     c.Nostr.RelayURLs(),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceByType["nostr"] = nostr
+		closers = append(closers, nostr.Close)
+		platforms = append(platforms, "nostr")
+	}
+	if c.Huawei.ClientID != "" {
+		serviceByType["huawei"] = services.NewHuawei(createHuaweiMessageFactory(), services.HuaweiConfig{
+			AppID:        c.Huawei.AppID,
+			ClientID:     c.Huawei.ClientID,
+			ClientSecret: c.Huawei.ClientSecret,
+		})
+		platforms = append(platforms, "huawei")
+	}
+	if c.MQTT.Broker != "" {
+		mqtt, err := services.NewMQTT(createMQTTMessageFactory(), services.MQTTConfig{
+			Broker:      c.MQTT.Broker,
+			Username:    c.MQTT.Username,
+			Password:    c.MQTT.Password,
+			ClientID:    c.MQTT.ClientID,
+			TopicPrefix: c.MQTT.TopicPrefix,
+			QoS:         byte(c.MQTT.QoS),
+			Retained:    c.MQTT.Retained,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		serviceByType["mqtt"] = mqtt
+		closers = append(closers, mqtt.Close)
+		platforms = append(platforms, "mqtt")
+	}
+	if live != nil {
+		serviceByType["live"] = live
+		platforms = append(platforms, "live")
+	}
+	if c.Retry.MaxAttempts > 1 {
+		retryPolicy := notify.RetryPolicy{
+			MaxAttempts:    c.Retry.MaxAttempts,
+			InitialBackoff: c.Retry.InitialBackoff,
+			MaxBackoff:     c.Retry.MaxBackoff,
+			Jitter:         0.2,
+		}
+		// Explicitly passed options take precedence over the configured ones.
+		var retryOpts []notify.Option
+		for _, platform := range platforms {
+			retryOpts = append(retryOpts, notify.WithRetryPolicy(platform, retryPolicy))
+		}
+		opts = append(retryOpts, opts...)
+	}
+	if c.Breaker.FailureThreshold > 0 {
+		breakerPolicy := notify.BreakerPolicy{
+			FailureThreshold: c.Breaker.FailureThreshold,
+			OpenTimeout:      c.Breaker.OpenTimeout,
+			HalfOpenRequests: c.Breaker.HalfOpenRequests,
+		}
+		var breakerOpts []notify.Option
+		for _, platform := range platforms {
+			breakerOpts = append(breakerOpts, notify.WithCircuitBreaker(platform, breakerPolicy))
+		}
+		opts = append(breakerOpts, opts...)
+	}
+	if c.TokenInvalidatedWebhookURL != "" {
+		opts = append([]notify.Option{
+			notify.WithTokenInvalidatedHandler(notify.TokenInvalidatedWebhook(c.TokenInvalidatedWebhookURL, tokenWebhookTimeout)),
+		}, opts...)
+	}
+	// A payer is waiting on the lnurl and bolt12 notifications, while the
+	// confirmations can be delayed.
+	opts = append([]notify.Option{
+		notify.WithTemplatePriority(notify.NOTIFICATION_INVOICE_REQUEST, notify.PriorityHigh),
+		notify.WithTemplatePriority(notify.NOTIFICATION_LNURLPAY_INFO, notify.PriorityHigh),
+		notify.WithTemplatePriority(notify.NOTIFICATION_LNURLPAY_INVOICE, notify.PriorityHigh),
+		notify.WithTemplatePriority(notify.NOTIFICATION_LNURLPAY_VERIFY, notify.PriorityHigh),
+		notify.WithTemplatePriority(notify.NOTIFICATION_TX_CONFIRMED, notify.PriorityLow),
+		notify.WithTemplatePriority(notify.NOTIFICATION_ADDRESS_TXS_CONFIRMED, notify.PriorityLow),
+	}, opts...)
+	closeServices := func() {
+		for _, closeService := range closers {
+			closeService()
+		}
+	}
+	return notify.NewNotifier(c, serviceByType, opts...), closeServices, nil
+}
+
+// newAPNS returns the APNs service of the apns platform, whose tokens are
+// APNs device tokens. The ios platform keeps sending the FCM tokens through
+// FCM.
+func newAPNS(c *config.APNSConfig) (*services.APNS, error) {
+	p8, err := os.ReadFile(c.KeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read apns key %w", err)
+	}
+	key, err := services.ParseAPNSKey(p8)
+	if err != nil {
+		return nil, err
+	}
+	endpoint := services.APNSProduction
+	if c.Development {
+		endpoint = services.APNSDevelopment
+	}
+	return services.NewAPNS(createAPNSMessageFactory(), services.APNSConfig{
+		KeyID:    c.KeyID,
+		TeamID:   c.TeamID,
+		Key:      key,
+		Topic:    c.Topic,
+		Endpoint: endpoint,
 	}), nil
 }
 
+func newWebhook(c *config.WebhookConfig) (*services.Webhook, error) {
+	data, err := os.ReadFile(c.TargetsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read webhook targets %w", err)
+	}
+	var targets map[string]services.WebhookTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("failed to parse webhook targets %w", err)
+	}
+	return services.NewWebhook(services.WebhookConfig{
+		Targets:    targets,
+		Timeout:    c.Timeout,
+		PublicOnly: c.PublicOnly,
+	})
+}
+
 func createMessageFactory() services.FCMMessageBuilder {
 	return func(notification *notify.Notification) (*messaging.Message, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
+		}
+		return createPush(notification)
+	}
+}
 
-		switch notification.Template {
-		case notify.NOTIFICATION_PAYMENT_RECEIVED,
-			notify.NOTIFICATION_TX_CONFIRMED,
-			notify.NOTIFICATION_ADDRESS_TXS_CONFIRMED,
-			notify.NOTIFICATION_LNURLPAY_INFO,
-			notify.NOTIFICATION_LNURLPAY_INVOICE,
-			notify.NOTIFICATION_LNURLPAY_VERIFY,
-			notify.NOTIFICATION_SWAP_UPDATED,
-			notify.NOTIFICATION_INVOICE_REQUEST,
-			notify.NOTIFICATION_NWC_EVENT:
+func createAPNSMessageFactory() services.APNSMessageBuilder {
+	return func(notification *notify.Notification) (*services.APNSMessage, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
+		}
+		return createAPNSPush(notification)
+	}
+}
 
-			return createPush(notification)
+func createWebPushMessageFactory() services.WebPushMessageBuilder {
+	return func(notification *notify.Notification) (*services.WebPushMessage, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
 		}
+		return createWebPush(notification)
+	}
+}
 
-		return nil, nil
+func createUnifiedPushMessageFactory() services.UnifiedPushMessageBuilder {
+	return func(notification *notify.Notification) (*services.UnifiedPushMessage, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
+		}
+		return createUnifiedPush(notification)
 	}
 }
 
-func createPush(notification *notify.Notification) (*messaging.Message, error) {
+func createNostrMessageFactory() services.NostrMessageBuilder {
+	return func(notification *notify.Notification) (*services.NostrMessage, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
+		}
+		return createNostrMessage(notification)
+	}
+}
+
+func createHuaweiMessageFactory() services.HuaweiMessageBuilder {
+	return func(notification *notify.Notification) (*services.HuaweiMessage, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
+		}
+		return createHuaweiPush(notification)
+	}
+}
+
+func createMQTTMessageFactory() services.MQTTMessageBuilder {
+	return func(notification *notify.Notification) (*services.MQTTMessage, error) {
+		if !isSupportedTemplate(notification.Template) {
+			return nil, nil
+		}
+		return createMQTTMessage(notification)
+	}
+}
+
+func isSupportedTemplate(template string) bool {
+	switch template {
+	case notify.NOTIFICATION_PAYMENT_RECEIVED,
+		notify.NOTIFICATION_TX_CONFIRMED,
+		notify.NOTIFICATION_ADDRESS_TXS_CONFIRMED,
+		notify.NOTIFICATION_LNURLPAY_INFO,
+		notify.NOTIFICATION_LNURLPAY_INVOICE,
+		notify.NOTIFICATION_LNURLPAY_VERIFY,
+		notify.NOTIFICATION_SWAP_UPDATED,
+		notify.NOTIFICATION_INVOICE_REQUEST,
+		notify.NOTIFICATION_NWC_EVENT:
+		return true
+	}
+	return false
+}
+
+// pushData is the data the app receives with every push notification.
+func pushData(notification *notify.Notification) (map[string]string, error) {
 	data := make(map[string]string)
 
 	data["notification_type"] = notification.Template
@@ -51,6 +285,14 @@ func createPush(notification *notify.Notification) (*messaging.Message, error) {
 		return nil, fmt.Errorf("failed to marshal notification data %v", err)
 	}
 	data["notification_payload"] = string(payload)
+	return data, nil
+}
+
+func createPush(notification *notify.Notification) (*messaging.Message, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
 
 	return &messaging.Message{
 		Token: notification.TargetIdentifier,
@@ -74,3 +316,116 @@ func createPush(notification *notify.Notification) (*messaging.Message, error) {
 		},
 	}, nil
 }
+
+// createAPNSPush mirrors the APNs part of createPush: a mutable alert the
+// notification service extension of the app handles, with the push data as
+// custom keys.
+func createAPNSPush(notification *notify.Notification) (*services.APNSMessage, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":           map[string]string{"title": notification.DisplayMessage},
+			"mutable-content": 1,
+		},
+	}
+	for key, value := range data {
+		payload[key] = value
+	}
+
+	return &services.APNSMessage{
+		DeviceToken: notification.TargetIdentifier,
+		PushType:    services.APNSPushTypeAlert,
+		Priority:    services.APNSPriorityHigh,
+		Payload:     payload,
+	}, nil
+}
+
+// createWebPush sends the push data and the title as a JSON payload, for
+// the service worker of the web wallet to display.
+func createWebPush(notification *notify.Notification) (*services.WebPushMessage, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
+	data["title"] = notification.DisplayMessage
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal web push payload %v", err)
+	}
+
+	return &services.WebPushMessage{
+		Payload: payload,
+		Urgency: services.WebPushUrgencyHigh,
+	}, nil
+}
+
+// createUnifiedPush sends the data of createPush as a JSON object, the app
+// receives it from its distributor as is.
+func createUnifiedPush(notification *notify.Notification) (*services.UnifiedPushMessage, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal unifiedpush payload %v", err)
+	}
+
+	return &services.UnifiedPushMessage{
+		Payload: payload,
+		Urgency: services.WebPushUrgencyHigh,
+	}, nil
+}
+
+// createNostrMessage sends the data of createPush as the encrypted content
+// of the event.
+func createNostrMessage(notification *notify.Notification) (*services.NostrMessage, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
+	content, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal nostr content %v", err)
+	}
+
+	return &services.NostrMessage{Content: content}, nil
+}
+
+// createMQTTMessage publishes the data of createPush as JSON.
+func createMQTTMessage(notification *notify.Notification) (*services.MQTTMessage, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal mqtt payload %v", err)
+	}
+
+	return &services.MQTTMessage{Payload: payload}, nil
+}
+
+// createHuaweiPush mirrors the Android part of createPush: a high priority
+// data message with the push data as its JSON payload.
+func createHuaweiPush(notification *notify.Notification) (*services.HuaweiMessage, error) {
+	data, err := pushData(notification)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal huawei data %v", err)
+	}
+
+	return &services.HuaweiMessage{
+		Data: string(payload),
+		Android: &services.HuaweiAndroidConfig{
+			Urgency: "HIGH",
+		},
+		Token: []string{notification.TargetIdentifier},
+	}, nil
+}
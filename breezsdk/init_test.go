@@ -0,0 +1,87 @@
+package breezsdk
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"google.golang.org/api/option"
+	"gotest.tools/v3/assert"
+)
+
+// rewriteTransport sends all the requests to a test server.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// newTestFCMClient returns an FCM client sending to a test server, which
+// reports the tokens of the messages.
+func newTestFCMClient(t *testing.T) (*messaging.Client, chan string) {
+	tokens := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Message struct {
+				Token string `json:"token"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		tokens <- body.Message.Token
+		w.Write([]byte(`{"name": "projects/test/messages/1"}`))
+	}))
+	t.Cleanup(server.Close)
+	target, _ := url.Parse(server.URL)
+	app, err := firebase.NewApp(context.Background(), &firebase.Config{ProjectID: "test"},
+		option.WithHTTPClient(&http.Client{Transport: &rewriteTransport{target: target}}))
+	assert.NilError(t, err)
+	client, err := app.Messaging(context.Background())
+	assert.NilError(t, err)
+	return client, tokens
+}
+
+func TestIOSStaysOnFCMWithAPNS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NilError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "key.p8")
+	assert.NilError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	fcmClient, tokens := newTestFCMClient(t)
+	c := &config.Config{
+		WorkersNum: 1,
+		APNS:       config.APNSConfig{KeyPath: keyPath, KeyID: "key", TeamID: "team", Topic: "app"},
+	}
+	notifier, closeServices, err := NewNotifier(c, fcmClient, nil)
+	assert.NilError(t, err)
+	defer closeServices()
+	defer notifier.Shutdown(context.Background())
+
+	_, err = notifier.Notify(context.Background(), &notify.Notification{
+		Template:         notify.NOTIFICATION_PAYMENT_RECEIVED,
+		Type:             "ios",
+		TargetIdentifier: "fcm-token",
+		Data:             map[string]interface{}{"payment_hash": "1234"},
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, <-tokens, "fcm-token")
+}
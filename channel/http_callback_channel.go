@@ -6,16 +6,21 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/breez/notify/notify"
-	"github.com/google/martian/v3/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
 const (
 	callbackTimeout = 60 * time.Second
+	tracerName      = "github.com/breez/notify/channel"
 )
 
 type PendingRequest struct {
@@ -29,23 +34,66 @@ type HttpCallbackChannel struct {
 	callbackBaseURL string
 	random          *rand.Rand
 	pendingRequests map[uint64]*PendingRequest
+	shutdown        chan struct{}
+	shutdownOnce    sync.Once
+	logger          *slog.Logger
 }
 
-func NewHttpCallbackChannel(callbackBaseURL string) *HttpCallbackChannel {
+type Option func(*HttpCallbackChannel)
+
+// WithLogger sets the logger of the channel. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(p *HttpCallbackChannel) {
+		p.logger = logger
+	}
+}
+
+func NewHttpCallbackChannel(callbackBaseURL string, opts ...Option) *HttpCallbackChannel {
 	channel := &HttpCallbackChannel{
 		httpClient:      http.DefaultClient,
 		callbackBaseURL: strings.TrimRight(callbackBaseURL, "/"),
 		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
 		pendingRequests: make(map[uint64]*PendingRequest),
+		shutdown:        make(chan struct{}),
+		logger:          slog.Default(),
+	}
+	for _, opt := range opts {
+		opt(channel)
 	}
 
 	return channel
 }
 
-func (p *HttpCallbackChannel) Notify(c context.Context, notifier *notify.Notifier, basePath string, request *notify.Notification) (string, error) {
+// Notify sends the notification and waits for the device to post its reply to
+// the callback URL. It returns the delivery id of the notification and the
+// reply.
+func (p *HttpCallbackChannel) Notify(c context.Context, notifier *notify.Notifier, basePath string, request *notify.Notification) (deliveryID string, response string, err error) {
+	c, span := otel.Tracer(tracerName).Start(c, "HttpCallbackChannel.Notify",
+		trace.WithAttributes(notify.AttributeTemplate.String(request.Template)))
+	defer func() { notify.EndSpan(span, err) }()
+
+	select {
+	case <-p.shutdown:
+		return "", "", notify.ErrShuttingDown
+	default:
+	}
+
+	p.Lock()
 	reqID := p.random.Uint64()
+	p.Unlock()
 	trimmedBasePath := strings.Trim(basePath, "/")
 	callbackURL := fmt.Sprintf("%s/%s/response/%d", p.callbackBaseURL, trimmedBasePath, reqID)
+	// The trace context travels in the reply url, so the reply continues the
+	// trace of the request.
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(c, carrier)
+	if len(carrier) > 0 {
+		query := url.Values{}
+		for _, key := range carrier.Keys() {
+			query.Set(key, carrier.Get(key))
+		}
+		callbackURL += "?" + query.Encode()
+	}
 	request.Data["reply_url"] = callbackURL
 
 	pendingRequest := &PendingRequest{
@@ -66,24 +114,33 @@ func (p *HttpCallbackChannel) Notify(c context.Context, notifier *notify.Notifie
 		p.Unlock()
 	}()
 
-	log.Debugf("waiting for response: %v", callbackURL)
+	logger := p.logger.With("request_id", notify.RequestID(c), "callback_id", reqID)
+	logger.Debug("waiting for response", "reply_url", callbackURL)
 
-	if err := notifier.Notify(c, request); err != nil {
-		log.Debugf("failed to notify, request: %v, error: %v", request, err)
-		return "", err
+	deliveryID, err = notifier.Notify(c, request)
+	if err != nil {
+		logger.Debug("failed to notify", "notification", request, "error", err)
+		return "", "", err
 	}
 
 	select {
 	case result := <-pendingRequest.result:
-		return result, nil
+		return deliveryID, result, nil
 	case <-c.Done():
-		return "", errors.New("canceled")
+		return deliveryID, "", errors.New("canceled")
+	case <-p.shutdown:
+		return deliveryID, "", notify.ErrShuttingDown
 	case <-time.After(callbackTimeout):
-		return "", errors.New("timeout")
+		return deliveryID, "", errors.New("timeout")
 	}
 }
 
-func (p *HttpCallbackChannel) OnResponse(reqID uint64, payload string) error {
+// OnResponse passes the reply of a device to the pending request. ctx should
+// carry the trace context found in the reply url.
+func (p *HttpCallbackChannel) OnResponse(ctx context.Context, reqID uint64, payload string) (err error) {
+	_, span := otel.Tracer(tracerName).Start(ctx, "HttpCallbackChannel.OnResponse")
+	defer func() { notify.EndSpan(span, err) }()
+
 	p.Lock()
 	defer p.Unlock()
 	pendingRequest, ok := p.pendingRequests[reqID]
@@ -100,3 +157,17 @@ func (p *HttpCallbackChannel) deleteRequestAndClose(req *PendingRequest) {
 	delete(p.pendingRequests, req.id)
 	close(req.result)
 }
+
+// Shutdown fails the pending and future requests with notify.ErrShuttingDown.
+func (p *HttpCallbackChannel) Shutdown() {
+	p.shutdownOnce.Do(func() {
+		close(p.shutdown)
+	})
+}
+
+// PendingCount returns the number of requests waiting for a device reply.
+func (p *HttpCallbackChannel) PendingCount() int {
+	p.Lock()
+	defer p.Unlock()
+	return len(p.pendingRequests)
+}
@@ -2,22 +2,227 @@ package config
 
 import (
 	"fmt"
+	"strings"
+	"time"
 )
 
 type HTTPConfig struct {
-	Address string `env:"NOTIFY_HTTP_ADDRESS"`
+	Address    string `env:"NOTIFY_HTTP_ADDRESS"`
+	AdminToken string `env:"NOTIFY_ADMIN_TOKEN"`
+	// ShutdownTimeout bounds the wait for running requests on shutdown.
+	ShutdownTimeout time.Duration `env:"NOTIFY_HTTP_SHUTDOWN_TIMEOUT"`
+	// IdempotencyWindow is how long a webhook is remembered to suppress its
+	// duplicates. Zero disables the suppression.
+	IdempotencyWindow time.Duration `env:"NOTIFY_IDEMPOTENCY_WINDOW"`
+}
+
+type RetryConfig struct {
+	MaxAttempts    int           `env:"NOTIFY_RETRY_MAX_ATTEMPTS"`
+	InitialBackoff time.Duration `env:"NOTIFY_RETRY_INITIAL_BACKOFF"`
+	MaxBackoff     time.Duration `env:"NOTIFY_RETRY_MAX_BACKOFF"`
+}
+
+type BreakerConfig struct {
+	// FailureThreshold consecutive failures of a service open its circuit
+	// breaker. Zero disables the circuit breakers.
+	FailureThreshold int           `env:"NOTIFY_BREAKER_FAILURE_THRESHOLD"`
+	OpenTimeout      time.Duration `env:"NOTIFY_BREAKER_OPEN_TIMEOUT"`
+	HalfOpenRequests int           `env:"NOTIFY_BREAKER_HALF_OPEN_REQUESTS"`
+}
+
+// APNSConfig enables the direct APNs service for the apns platform, with the
+// token-based authentication of the .p8 key in KeyPath.
+type APNSConfig struct {
+	KeyPath string `env:"NOTIFY_APNS_KEY_PATH"`
+	KeyID   string `env:"NOTIFY_APNS_KEY_ID"`
+	TeamID  string `env:"NOTIFY_APNS_TEAM_ID"`
+	// Topic is the bundle id of the app.
+	Topic string `env:"NOTIFY_APNS_TOPIC"`
+	// Development sends to the APNs sandbox.
+	Development bool `env:"NOTIFY_APNS_DEVELOPMENT"`
+}
+
+// UnifiedPushConfig enables the UnifiedPush service for the unifiedpush
+// platform.
+type UnifiedPushConfig struct {
+	// Hosts is the comma separated list of the push servers the endpoints
+	// may point to, e.g. ntfy.sh. "*.example.com" matches the subdomains.
+	Hosts string `env:"NOTIFY_UNIFIEDPUSH_HOSTS"`
+}
+
+// HostList returns the parsed Hosts.
+func (c *UnifiedPushConfig) HostList() []string {
+	return splitList(c.Hosts)
+}
+
+// WebPushConfig enables the Web Push service for the web platform.
+type WebPushConfig struct {
+	// VAPIDPrivateKey is the base64url encoded P-256 private key of the
+	// VAPID key pair the browsers subscribe with.
+	VAPIDPrivateKey string `env:"NOTIFY_VAPID_PRIVATE_KEY"`
+	// VAPIDSubject is the mailto: or https: contact of the push services.
+	VAPIDSubject string `env:"NOTIFY_VAPID_SUBJECT"`
+	// Hosts is the comma separated list of the push services the
+	// subscriptions may point to. Defaults to those of the major browsers.
+	Hosts string `env:"NOTIFY_WEBPUSH_HOSTS"`
+}
+
+// HostList returns the parsed Hosts.
+func (c *WebPushConfig) HostList() []string {
+	return splitList(c.Hosts)
+}
+
+// WebhookConfig enables the webhook platform, which POSTs the
+// notifications to the url of their target.
+type WebhookConfig struct {
+	// TargetsPath is the JSON file of the targets by id, each with its url
+	// and the secret of its signatures.
+	TargetsPath string        `env:"NOTIFY_WEBHOOK_TARGETS_PATH"`
+	Timeout     time.Duration `env:"NOTIFY_WEBHOOK_TIMEOUT"`
+	// PublicOnly refuses to connect to the targets on private and loopback
+	// addresses.
+	PublicOnly bool `env:"NOTIFY_WEBHOOK_PUBLIC_ONLY"`
+}
+
+// NostrConfig enables the nostr platform, which publishes the notifications
+// as encrypted events to the target pubkey.
+type NostrConfig struct {
+	// PrivateKey is the hex private key the events are signed with.
+	PrivateKey string `env:"NOTIFY_NOSTR_PRIVATE_KEY"`
+	// Relays is a comma separated list of relay urls.
+	Relays string `env:"NOTIFY_NOSTR_RELAYS"`
+}
+
+// RelayURLs returns the parsed Relays.
+func (c *NostrConfig) RelayURLs() []string {
+	return splitList(c.Relays)
+}
+
+// LiveConfig enables the live platform, which delivers the notifications
+// over the WebSocket or server-sent events connections of the clients.
+type LiveConfig struct {
+	// Secret is the key of the HMAC-SHA256 of the identifier the clients
+	// connect with as their token.
+	Secret     string        `env:"NOTIFY_LIVE_SECRET"`
+	BufferSize int           `env:"NOTIFY_LIVE_BUFFER_SIZE"`
+	BufferTTL  time.Duration `env:"NOTIFY_LIVE_BUFFER_TTL"`
+}
+
+// MQTTConfig enables the mqtt platform, which publishes the notifications to
+// the topic of their target on a broker.
+type MQTTConfig struct {
+	// Broker is the url of the broker, e.g. tcp://host:1883.
+	Broker      string `env:"NOTIFY_MQTT_BROKER"`
+	Username    string `env:"NOTIFY_MQTT_USERNAME"`
+	Password    string `env:"NOTIFY_MQTT_PASSWORD"`
+	ClientID    string `env:"NOTIFY_MQTT_CLIENT_ID"`
+	TopicPrefix string `env:"NOTIFY_MQTT_TOPIC_PREFIX"`
+	// QoS is 0 (default), 1 or 2.
+	QoS      int  `env:"NOTIFY_MQTT_QOS"`
+	Retained bool `env:"NOTIFY_MQTT_RETAINED"`
+}
+
+// HuaweiConfig enables the huawei platform, which sends the notifications
+// with Huawei Push Kit.
+type HuaweiConfig struct {
+	// AppID defaults to ClientID.
+	AppID        string `env:"NOTIFY_HUAWEI_APP_ID"`
+	ClientID     string `env:"NOTIFY_HUAWEI_CLIENT_ID"`
+	ClientSecret string `env:"NOTIFY_HUAWEI_CLIENT_SECRET"`
 }
 
 type Config struct {
-	WorkersNum  int `env:"NOTIFY_WORKERS_NUM"`
+	WorkersNum  int    `env:"NOTIFY_WORKERS_NUM"`
 	ExternalURL string `env:"NOTIFY_EXTERNAL_URL"`
+	StorePath   string `env:"NOTIFY_STORE_PATH"`
 	HTTPConfig  HTTPConfig
+	Retry       RetryConfig
+	Breaker     BreakerConfig
+	APNS        APNSConfig
+	UnifiedPush UnifiedPushConfig
+	WebPush     WebPushConfig
+	Webhook     WebhookConfig
+	Nostr       NostrConfig
+	Live        LiveConfig
+	MQTT        MQTTConfig
+	Huawei      HuaweiConfig
+
+	// High and low priority notifications get their own workers when set,
+	// otherwise they share the WorkersNum ones.
+	HighPriorityWorkersNum int `env:"NOTIFY_HIGH_PRIORITY_WORKERS_NUM"`
+	LowPriorityWorkersNum  int `env:"NOTIFY_LOW_PRIORITY_WORKERS_NUM"`
+	// OrderByTarget sends the notifications of the same priority to the same
+	// target one at a time, in the order they were queued.
+	OrderByTarget bool `env:"NOTIFY_ORDER_BY_TARGET"`
+
+	// SendTimeout is the default deadline of a single send.
+	SendTimeout time.Duration `env:"NOTIFY_SEND_TIMEOUT"`
+	// ShutdownTimeout bounds the wait for queued notifications on shutdown.
+	ShutdownTimeout time.Duration `env:"NOTIFY_SHUTDOWN_TIMEOUT"`
+
+	// TokenInvalidatedWebhookURL is called with the tokens FCM reports
+	// invalid, so they can be removed where the webhooks come from.
+	TokenInvalidatedWebhookURL string `env:"NOTIFY_TOKEN_INVALIDATED_WEBHOOK_URL"`
+
+	// OTLPEndpoint is the host:port of the OTLP/HTTP collector the traces
+	// are exported to. Tracing is disabled when empty.
+	OTLPEndpoint string `env:"NOTIFY_OTLP_ENDPOINT"`
+	// OTLPInsecure exports the traces over plain http.
+	OTLPInsecure bool `env:"NOTIFY_OTLP_INSECURE"`
+
+	// LogFormat is json (default) or text.
+	LogFormat string `env:"NOTIFY_LOG_FORMAT"`
+	// LogLevel is debug, info (default), warn or error.
+	LogLevel string `env:"NOTIFY_LOG_LEVEL"`
+	// LogRedactKeys is a comma separated list of notification data keys
+	// masked in the logs, on top of the default ones.
+	LogRedactKeys string `env:"NOTIFY_LOG_REDACT_KEYS"`
+}
+
+// RedactKeys returns the parsed LogRedactKeys.
+func (c *Config) RedactKeys() []string {
+	return splitList(c.LogRedactKeys)
+}
+
+// splitList splits a comma separated list, as go-env has no slices.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func (c *Config) Validate() error {
 	if c.WorkersNum < 1 {
 		return fmt.Errorf("WorkersNum must be greater than zero")
 	}
+	if c.HighPriorityWorkersNum < 0 || c.LowPriorityWorkersNum < 0 {
+		return fmt.Errorf("priority WorkersNum must not be negative")
+	}
+	if c.Retry.MaxAttempts < 0 {
+		return fmt.Errorf("Retry.MaxAttempts must not be negative")
+	}
+	if c.APNS.KeyPath != "" && (c.APNS.KeyID == "" || c.APNS.TeamID == "" || c.APNS.Topic == "") {
+		return fmt.Errorf("APNS.KeyID, APNS.TeamID and APNS.Topic are required with APNS.KeyPath")
+	}
+	if c.WebPush.VAPIDPrivateKey != "" && c.WebPush.VAPIDSubject == "" {
+		return fmt.Errorf("WebPush.VAPIDSubject is required with WebPush.VAPIDPrivateKey")
+	}
+	if c.Nostr.PrivateKey != "" && len(c.Nostr.RelayURLs()) == 0 {
+		return fmt.Errorf("Nostr.Relays is required with Nostr.PrivateKey")
+	}
+	if c.Huawei.ClientID != "" && c.Huawei.ClientSecret == "" {
+		return fmt.Errorf("Huawei.ClientSecret is required with Huawei.ClientID")
+	}
+	if c.MQTT.QoS < 0 || c.MQTT.QoS > 2 {
+		return fmt.Errorf("MQTT.QoS must be 0, 1 or 2")
+	}
+	if c.Breaker.FailureThreshold < 0 {
+		return fmt.Errorf("Breaker.FailureThreshold must not be negative")
+	}
 
 	return nil
 }
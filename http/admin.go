@@ -0,0 +1,102 @@
+package http
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// addAdminRouter registers the operational endpoints. All of them require the
+// configured admin token as a bearer token.
+func addAdminRouter(r *gin.RouterGroup, notifier *notify.Notifier, adminToken string) {
+	r.Use(requireToken(adminToken))
+
+	r.GET("/deadletters", func(c *gin.Context) {
+		letters, err := notifier.DeadLetters()
+		if err != nil {
+			abortWithNotifierError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, letters)
+	})
+
+	r.GET("/deadletters/:id", func(c *gin.Context) {
+		letter, err := notifier.DeadLetter(c.Param("id"))
+		if err != nil {
+			abortWithNotifierError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, letter)
+	})
+
+	r.POST("/deadletters/:id/requeue", func(c *gin.Context) {
+		deliveryID, err := notifier.Requeue(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			abortWithNotifierError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"delivery_id": deliveryID})
+	})
+
+	r.GET("/scheduled", func(c *gin.Context) {
+		c.JSON(http.StatusOK, notifier.Scheduled())
+	})
+
+	r.DELETE("/scheduled/:id", func(c *gin.Context) {
+		if err := notifier.CancelScheduled(c.Param("id")); err != nil {
+			abortWithNotifierError(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	r.DELETE("/blocked_tokens/:type/:token", func(c *gin.Context) {
+		if err := notifier.UnblockToken(c.Param("type"), c.Param("token")); err != nil {
+			abortWithNotifierError(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	r.GET("/circuits", func(c *gin.Context) {
+		c.JSON(http.StatusOK, notifier.Circuits())
+	})
+
+	r.POST("/circuits/:service/reset", func(c *gin.Context) {
+		if err := notifier.ResetCircuit(c.Param("service")); err != nil {
+			abortWithNotifierError(c, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+}
+
+func requireToken(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func abortWithNotifierError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, notify.ErrDeadLetterNotFound),
+		errors.Is(err, notify.ErrCircuitNotFound),
+		errors.Is(err, notify.ErrScheduledNotFound):
+		c.AbortWithError(http.StatusNotFound, err)
+	case errors.Is(err, notify.ErrDeadLettersNotEnabled),
+		errors.Is(err, notify.ErrTokenBlocklistNotEnabled):
+		c.AbortWithError(http.StatusNotImplemented, err)
+	default:
+		requestLog(c).Error("admin request failed", "error", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,165 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	idempotencyPruneInterval = time.Minute
+)
+
+// NaturalKeyed is implemented by the payloads that identify the event they
+// notify about, so that a retried webhook for the same event is recognized
+// without an Idempotency-Key header.
+type NaturalKeyed interface {
+	NaturalKey() string
+}
+
+// idempotencyKey returns the key identifying the webhook, scoped to its
+// target and template, or an empty string when the webhook has no key.
+func idempotencyKey(c *gin.Context, notification *notify.Notification, payload NotificationConvertible) string {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		keyed, ok := payload.(NaturalKeyed)
+		if !ok {
+			return ""
+		}
+		key = keyed.NaturalKey()
+	}
+	h := sha256.New()
+	for _, part := range []string{notification.Type, notification.TargetIdentifier, notification.Template, key} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type idempotentResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type idempotencyEntry struct {
+	done     chan struct{}
+	response *idempotentResponse
+	expires  time.Time
+}
+
+// idempotencyCache suppresses the webhooks repeated within the window and
+// replays the response of the first one to them.
+type idempotencyCache struct {
+	sync.Mutex
+	window     time.Duration
+	entries    map[string]*idempotencyEntry
+	lastPruned time.Time
+}
+
+func newIdempotencyCache(window time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		window:  window,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// handle runs next for the first webhook with the given key and records its
+// response when it succeeded. Concurrent webhooks with the same key wait for
+// the first one and get its response; if it failed, they run next themselves.
+func (i *idempotencyCache) handle(c *gin.Context, key string, next func()) {
+	i.Lock()
+	i.prune()
+	entry, ok := i.entries[key]
+	if ok && entry.response != nil && time.Now().After(entry.expires) {
+		ok = false
+	}
+	if !ok {
+		entry = &idempotencyEntry{done: make(chan struct{})}
+		i.entries[key] = entry
+		i.Unlock()
+		i.record(c, key, entry, next)
+		return
+	}
+	i.Unlock()
+
+	select {
+	case <-entry.done:
+	case <-c.Request.Context().Done():
+		c.AbortWithStatus(http.StatusRequestTimeout)
+		return
+	}
+	if entry.response == nil {
+		i.handle(c, key, next)
+		return
+	}
+	for k, v := range entry.response.header {
+		// The request id is the one of this request.
+		if k == requestIDHeader {
+			continue
+		}
+		c.Writer.Header()[k] = v
+	}
+	c.Header(idempotentReplayedHeader, "true")
+	c.Status(entry.response.status)
+	c.Writer.Write(entry.response.body)
+}
+
+func (i *idempotencyCache) record(c *gin.Context, key string, entry *idempotencyEntry, next func()) {
+	recorder := &responseRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	defer func() {
+		c.Writer = recorder.ResponseWriter
+		i.Lock()
+		defer i.Unlock()
+		if status := recorder.Status(); status >= 200 && status < 300 {
+			entry.response = &idempotentResponse{
+				status: status,
+				header: recorder.Header().Clone(),
+				body:   recorder.body,
+			}
+			entry.expires = time.Now().Add(i.window)
+		} else {
+			delete(i.entries, key)
+		}
+		close(entry.done)
+	}()
+	next()
+}
+
+// prune removes the expired entries. It must be called with the lock held.
+func (i *idempotencyCache) prune() {
+	if time.Since(i.lastPruned) < idempotencyPruneInterval {
+		return
+	}
+	now := time.Now()
+	i.lastPruned = now
+	for key, entry := range i.entries {
+		if entry.response != nil && now.After(entry.expires) {
+			delete(i.entries, key)
+		}
+	}
+}
+
+// responseRecorder keeps a copy of the response body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body []byte
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body = append(r.body, b...)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body = append(r.body, s...)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,110 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/breez/notify/notify/services"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// liveKeepAlive is the interval of the comments written to the idle event
+// streams, so the proxies don't close them.
+const liveKeepAlive = 30 * time.Second
+
+// addLiveRouter registers the endpoint the clients without a push token
+// hold their live connection on. The connection is a WebSocket when the
+// client asks for an upgrade, and a server-sent events stream otherwise.
+// Every message is the JSON envelope of a notification.
+func addLiveRouter(r *gin.RouterGroup, live *services.Live) {
+	r.GET("/live/:identifier", func(c *gin.Context) {
+		identifier := c.Param("identifier")
+		// The browsers can't set headers on an EventSource or a WebSocket,
+		// so the token is also accepted in the query.
+		token := c.Query("token")
+		if header := c.GetHeader("Authorization"); header != "" {
+			token = strings.TrimPrefix(header, "Bearer ")
+		}
+		if !live.Authenticate(identifier, token) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+
+		conn := live.Connect(identifier)
+		defer conn.Close()
+		if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+			serveLiveWebSocket(c, conn)
+			return
+		}
+		serveLiveEvents(c, conn)
+	})
+}
+
+func serveLiveWebSocket(c *gin.Context, conn *services.LiveConnection) {
+	// Without a handshake the origin is not checked, the clients are
+	// authenticated by their token.
+	handler := websocket.Handler(func(ws *websocket.Conn) {
+		// The client sends nothing, reading only notices it is gone.
+		gone := make(chan struct{})
+		go func() {
+			defer close(gone)
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+		for {
+			select {
+			case message := <-conn.Messages():
+				if err := websocket.JSON.Send(ws, message); err != nil {
+					requestLog(c).Debug("failed to write live message", "delivery_id", message.DeliveryID, "error", err)
+					conn.Requeue(message)
+					return
+				}
+			case <-gone:
+				return
+			case <-conn.Done():
+				return
+			}
+		}
+	})
+	websocket.Server{Handler: handler}.ServeHTTP(c.Writer, c.Request)
+}
+
+func serveLiveEvents(c *gin.Context, conn *services.LiveConnection) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepAlive := time.NewTicker(liveKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case message := <-conn.Messages():
+			data, err := json.Marshal(message)
+			if err != nil {
+				requestLog(c).Error("failed to marshal live message", "delivery_id", message.DeliveryID, "error", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "id: %s\nevent: notification\ndata: %s\n\n", message.DeliveryID, data); err != nil {
+				requestLog(c).Debug("failed to write live message", "delivery_id", message.DeliveryID, "error", err)
+				conn.Requeue(message)
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-c.Request.Context().Done():
+			return
+		case <-conn.Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
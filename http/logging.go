@@ -0,0 +1,99 @@
+package http
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/breez/notify/notify/services"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+const loggerKey = "logger"
+
+type options struct {
+	metrics *Metrics
+	logger  *slog.Logger
+	live    *services.Live
+	drain   func()
+}
+
+type Option func(*options)
+
+// WithMetrics serves the metrics on /metrics.
+func WithMetrics(metrics *Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithLogger sets the logger of the requests. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// WithLive serves the live connections of the service on
+// /api/v1/live/:identifier.
+func WithLive(live *services.Live) Option {
+	return func(o *options) {
+		o.live = live
+	}
+}
+
+// WithDrain runs drain on shutdown once the server stopped accepting
+// requests, to send the queued notifications while the live connections are
+// still open. The live service is closed after it.
+func WithDrain(drain func()) Option {
+	return func(o *options) {
+		o.drain = drain
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{logger: slog.Default()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// requestLogger logs every request once it is handled. It runs after
+// requestScope, so the request id is known, and it logs the route rather
+// than the url, which holds the push token in its query.
+func requestLogger(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		l := logger.With("request_id", notify.RequestID(c.Request.Context()))
+		if tenant := notify.Tenant(c.Request.Context()); tenant != "" {
+			l = l.With("tenant", tenant)
+		}
+		c.Set(loggerKey, l)
+		c.Next()
+
+		level := slog.LevelInfo
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []any{
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+		}
+		if len(c.Errors) > 0 {
+			attrs = append(attrs, "error", c.Errors.Last().Err)
+		}
+		l.Log(c.Request.Context(), level, "handled request", attrs...)
+	}
+}
+
+// requestLog returns the logger of the request.
+func requestLog(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,119 @@
+package http
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/breez/notify/channel"
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "notify"
+
+var circuitStateValue = map[notify.CircuitState]float64{
+	notify.CircuitClosed:   0,
+	notify.CircuitHalfOpen: 1,
+	notify.CircuitOpen:     2,
+}
+
+// Metrics collects the prometheus metrics served on /metrics. It is a
+// notify.MetricsRecorder, to be passed to the notify.Metrics middleware of
+// the Notifier.
+type Metrics struct {
+	registry     *prometheus.Registry
+	sends        *prometheus.CounterVec
+	sendDuration *prometheus.HistogramVec
+	webhooks     *prometheus.CounterVec
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		sends: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sends_total",
+			Help:      "Sends handed to the services, by outcome.",
+		}, []string{"template", "platform", "service", "result"}),
+		sendDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "send_duration_seconds",
+			Help:      "Duration of the sends handed to the services.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"template", "platform", "service"}),
+		webhooks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhooks_total",
+			Help:      "Webhooks received, by response status code.",
+		}, []string{"template", "platform", "code"}),
+	}
+	m.registry.MustRegister(
+		m.sends,
+		m.sendDuration,
+		m.webhooks,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+func (m *Metrics) ObserveSend(ctx context.Context, req *notify.Notification, duration time.Duration, err error) {
+	service := notify.ServiceType(ctx)
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.sends.WithLabelValues(req.Template, req.Type, service, result).Inc()
+	m.sendDuration.WithLabelValues(req.Template, req.Type, service).Observe(duration.Seconds())
+}
+
+func (m *Metrics) observeWebhook(notification *notify.Notification, code int) {
+	m.webhooks.WithLabelValues(notification.Template, notification.Type, strconv.Itoa(code)).Inc()
+}
+
+// watch adds the gauges of the queue lengths and of the requests waiting for
+// a device reply.
+func (m *Metrics) watch(notifier *notify.Notifier, channel *channel.HttpCallbackChannel) {
+	for priority := range notifier.QueueLength() {
+		priority := priority
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "queue_length",
+			Help:        "Notifications waiting for a worker.",
+			ConstLabels: prometheus.Labels{"priority": string(priority)},
+		}, func() float64 {
+			return float64(notifier.QueueLength()[priority])
+		}))
+	}
+	for _, circuit := range notifier.Circuits() {
+		service := circuit.Service
+		m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "circuit_state",
+			Help:        "State of the circuit breaker of a service: 0 closed, 1 half open, 2 open.",
+			ConstLabels: prometheus.Labels{"service": service},
+		}, func() float64 {
+			for _, c := range notifier.Circuits() {
+				if c.Service == service {
+					return circuitStateValue[c.State]
+				}
+			}
+			return 0
+		}))
+	}
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_callbacks",
+		Help:      "Requests waiting for a device reply.",
+	}, func() float64 {
+		return float64(channel.PendingCount())
+	}))
+}
+
+func (m *Metrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
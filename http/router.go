@@ -2,24 +2,63 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/breez/notify/channel"
 	"github.com/breez/notify/config"
 	"github.com/breez/notify/notify"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/google/martian/v3/log"
 )
 
+// deliveryIDHeader carries the delivery id of the notification sent for a
+// webhook, for the callback-bound ones whose body is the device reply.
+const deliveryIDHeader = "X-Delivery-Id"
+
+const (
+	requestIDHeader = "X-Request-Id"
+	tenantHeader    = "X-Tenant-Id"
+)
+
+const defaultShutdownTimeout = 10 * time.Second
+
 type MobilePushWebHookQuery struct {
-	Platform string  `form:"platform" binding:"required,oneof=ios android"`
-	Token    string  `form:"token" binding:"required"`
-	AppData  *string `form:"app_data"`
+	// Platform is the type of the notification, one of the services the
+	// notifier is configured with: ios, apns, android, huawei, web,
+	// unifiedpush, webhook, nostr, live or mqtt.
+	Platform string `form:"platform" binding:"required"`
+	// Token is the push token, the JSON PushSubscription of the browser for
+	// the web platform, the endpoint url for the unifiedpush platform, the
+	// id of a registered target for the webhook platform, the hex pubkey
+	// for the nostr platform, the identifier the client connected with for
+	// the live platform or the last level of the topic for the mqtt
+	// platform.
+	Token   string  `form:"token" binding:"required"`
+	AppData *string `form:"app_data"`
+	// SendAt (RFC 3339) or Delay (e.g. 90m) schedule the notification
+	// instead of sending it right away.
+	SendAt time.Time     `form:"send_at"`
+	Delay  time.Duration `form:"delay" binding:"min=0"`
+}
+
+// sendAt returns the time the notification is scheduled at, or the zero time
+// when it should be sent right away.
+func (q *MobilePushWebHookQuery) sendAt() time.Time {
+	if !q.SendAt.IsZero() {
+		return q.SendAt
+	}
+	if q.Delay > 0 {
+		return time.Now().Add(q.Delay)
+	}
+	return time.Time{}
 }
 
 type NotificationConvertible interface {
@@ -130,6 +169,10 @@ func (p *PaymentReceivedPayload) RequiresCallback() bool {
 	return false
 }
 
+func (p *PaymentReceivedPayload) NaturalKey() string {
+	return p.Data.PaymentHash
+}
+
 func (p *PaymentReceivedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
 	return &notify.Notification{
 		Template:         p.Template,
@@ -152,6 +195,10 @@ func (p *TxConfirmedPayload) RequiresCallback() bool {
 	return false
 }
 
+func (p *TxConfirmedPayload) NaturalKey() string {
+	return p.Data.TxID
+}
+
 func (p *TxConfirmedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
 	return &notify.Notification{
 		Template:         p.Template,
@@ -197,6 +244,10 @@ func (p *SwapUpdatedPayload) RequiresCallback() bool {
 	return false
 }
 
+func (p *SwapUpdatedPayload) NaturalKey() string {
+	return p.Data.Id + ":" + p.Data.Status
+}
+
 func (p *SwapUpdatedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
 	return &notify.Notification{
 		Template:         notify.NOTIFICATION_SWAP_UPDATED,
@@ -253,20 +304,88 @@ func (p *NwcEventPayload) ToNotification(query *MobilePushWebHookQuery) *notify.
 	}
 }
 
-func Run(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig) error {
-	r := setupRouter(notifier, channel)
+// Run serves the http api until ctx is done. It then stops accepting
+// webhooks, fails the requests waiting for a device reply, ends the live
+// connections and waits for the running handlers to return within
+// config.ShutdownTimeout.
+func Run(ctx context.Context, notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig, opts ...Option) error {
+	o := newOptions(opts)
+	r := setupRouter(notifier, channel, config, opts...)
 	r.SetTrustedProxies(nil)
-	return r.Run(config.Address)
-}
+	server := &http.Server{
+		Addr:    config.Address,
+		Handler: r,
+	}
 
-func setupRouter(notifier *notify.Notifier, channel *channel.HttpCallbackChannel) *gin.Engine {
-	r := gin.Default()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	o.logger.Info("shutting down web server")
+	timeout := config.ShutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	channel.Shutdown()
+	// The server stops accepting requests right away, but the live
+	// connections are requests that only end once the live service is
+	// closed, after the notifications queued for them are drained.
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- server.Shutdown(shutdownCtx)
+	}()
+	if o.drain != nil {
+		o.drain()
+	}
+	if o.live != nil {
+		o.live.Close()
+	}
+	timer := time.AfterFunc(timeout, cancel)
+	defer timer.Stop()
+	if err := <-stopped; err != nil {
+		return fmt.Errorf("failed to shutdown web server: %w", err)
+	}
+	return nil
+}
+
+func setupRouter(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig, opts ...Option) *gin.Engine {
+	o := newOptions(opts)
+	metrics := o.metrics
+	r := gin.New()
+	r.Use(gin.Recovery())
+	// Registered before the middlewares, so the scrapes are neither traced
+	// nor logged.
+	if metrics != nil {
+		metrics.watch(notifier, channel)
+		r.GET("/metrics", metrics.handler())
+	}
+	r.Use(tracing(), requestScope(), requestLogger(o.logger))
 	router := r.Group("api/v1")
-	addRouter(router, notifier, channel)
+	var idempotency *idempotencyCache
+	if config.IdempotencyWindow > 0 {
+		idempotency = newIdempotencyCache(config.IdempotencyWindow)
+	}
+	addRouter(router, notifier, channel, metrics, idempotency)
+	if o.live != nil {
+		addLiveRouter(router, o.live)
+	}
+	// The admin endpoints are only exposed when a token to protect them is configured.
+	if config.AdminToken != "" {
+		addAdminRouter(router.Group("admin"), notifier, config.AdminToken)
+	}
 	return r
 }
 
-func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.HttpCallbackChannel) {
+func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.HttpCallbackChannel, metrics *Metrics, idempotency *idempotencyCache) {
 	r.POST("/notify", func(c *gin.Context) {
 		body, _ := io.ReadAll(c.Request.Body)
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
@@ -277,6 +396,10 @@ func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.H
 			c.AbortWithError(http.StatusBadRequest, err)
 			return
 		}
+		if !notifier.HasService(query.Platform) {
+			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("unsupported platform %v", query.Platform))
+			return
+		}
 
 		// Find a matching notification payload
 		payloads := []NotificationConvertible{
@@ -300,33 +423,85 @@ func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.H
 		}
 
 		if validPayload == nil {
-			log.Debugf("invalid payload, body: %s", body)
-			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("unsupported payload, body: %s", body))
+			// The body is not logged, it holds the payment details.
+			requestLog(c).Debug("invalid payload", "size", len(body))
+			c.AbortWithError(http.StatusBadRequest, errors.New("unsupported payload"))
 			return
 		}
 
-		if validPayload.RequiresCallback() {
-			response, err := channel.Notify(c, notifier, r.BasePath(), validPayload.ToNotification(&query))
-			if c.IsAborted() {
+		notification := validPayload.ToNotification(&query)
+		if metrics != nil {
+			defer func() {
+				metrics.observeWebhook(notification, c.Writer.Status())
+			}()
+		}
+		sendAt := query.sendAt()
+		if !sendAt.IsZero() && validPayload.RequiresCallback() {
+			c.AbortWithError(http.StatusBadRequest, errors.New("notifications waiting for a reply can't be scheduled"))
+			return
+		}
+		send := func() {
+			if validPayload.RequiresCallback() {
+				deliveryID, response, err := channel.Notify(c.Request.Context(), notifier, r.BasePath(), notification)
+				if deliveryID != "" {
+					c.Header(deliveryIDHeader, deliveryID)
+				}
+				if err != nil {
+					requestLog(c).Debug("failed to notify with channel", "notification", notification, "error", err)
+					abortWithNotifyError(c, err)
+					return
+				}
+				c.Header("Content-Type", "application/json")
+				c.Writer.Write([]byte(response))
 				return
 			}
+
+			if !sendAt.IsZero() {
+				deliveryID, err := notifier.NotifyAt(c.Request.Context(), notification, sendAt)
+				if err != nil {
+					requestLog(c).Debug("failed to schedule notification", "notification", notification, "send_at", sendAt, "error", err)
+					abortWithNotifyError(c, err)
+					return
+				}
+				c.Header(deliveryIDHeader, deliveryID)
+				c.JSON(http.StatusOK, gin.H{"delivery_id": deliveryID, "send_at": sendAt.UTC()})
+				return
+			}
+
+			deliveryID, err := notifier.Notify(c.Request.Context(), notification)
 			if err != nil {
-				log.Debugf("failed to notify with channel, query: %v, error: %v", query, err)
-				c.AbortWithStatus(http.StatusInternalServerError)
+				requestLog(c).Debug("failed to notify", "notification", notification, "error", err)
+				abortWithNotifyError(c, err)
 				return
 			}
-			c.Header("Content-Type", "application/json")
-			c.Writer.Write([]byte(response))
-			return
-		} else {
-			if err := notifier.Notify(c, validPayload.ToNotification(&query)); err != nil {
-				log.Debugf("failed to notify, query: %v, error: %v", query, err)
-				c.AbortWithStatus(http.StatusInternalServerError)
+			c.Header(deliveryIDHeader, deliveryID)
+			c.JSON(http.StatusOK, gin.H{"delivery_id": deliveryID})
+		}
+
+		if idempotency != nil {
+			if key := idempotencyKey(c, notification, validPayload); key != "" {
+				idempotency.handle(c, key, send)
 				return
 			}
 		}
+		send()
+	})
 
-		c.Status(http.StatusOK)
+	r.GET("/deliveries/:id", func(c *gin.Context) {
+		delivery, err := notifier.Delivery(c.Param("id"))
+		switch {
+		case errors.Is(err, notify.ErrDeliveryNotFound):
+			c.AbortWithError(http.StatusNotFound, err)
+			return
+		case errors.Is(err, notify.ErrDeliveriesNotEnabled):
+			c.AbortWithError(http.StatusNotImplemented, err)
+			return
+		case err != nil:
+			requestLog(c).Error("failed to get delivery", "delivery_id", c.Param("id"), "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		c.JSON(http.StatusOK, delivery)
 	})
 
 	r.POST("/response/:responseId", func(c *gin.Context) {
@@ -344,7 +519,7 @@ func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.H
 			return
 		}
 
-		if err := channel.OnResponse(reqId, string(all)); err != nil {
+		if err := channel.OnResponse(c.Request.Context(), reqId, string(all)); err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
@@ -352,3 +527,43 @@ func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.H
 		c.Status(http.StatusOK)
 	})
 }
+
+func abortWithNotifyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, notify.ErrShuttingDown):
+		c.Header("Retry-After", "10")
+		c.AbortWithStatus(http.StatusServiceUnavailable)
+	case notify.IsInvalidToken(err):
+		// Tells the sender to stop sending webhooks for this token.
+		c.AbortWithError(http.StatusGone, err)
+	default:
+		c.AbortWithStatus(http.StatusInternalServerError)
+	}
+}
+
+// requestScope adds the request id and the tenant of the request to its
+// context, so they follow the notifications it triggers. A request id is
+// generated when the caller doesn't provide one.
+func requestScope() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" {
+			requestID = newRequestID()
+		}
+		c.Header(requestIDHeader, requestID)
+		ctx := notify.WithRequestID(c.Request.Context(), requestID)
+		if tenant := c.GetHeader(tenantHeader); tenant != "" {
+			ctx = notify.WithTenant(ctx, tenant)
+		}
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -1,16 +1,30 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/breez/notify/channel"
 	"github.com/breez/notify/config"
 	"github.com/breez/notify/notify"
+	"github.com/breez/notify/notify/services"
+	"github.com/breez/notify/notify/store"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/websocket"
 	"gotest.tools/assert"
 )
 
@@ -81,12 +95,92 @@ func TestAddressTXsChangedHook(t *testing.T) {
 	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, expected)
 }
 
+func TestWebPushHook(t *testing.T) {
+	subscription := `{"endpoint":"https://push.example.com/1","keys":{"p256dh":"key","auth":"secret"}}`
+	query := MobilePushWebHookQuery{
+		Platform: "web",
+		Token:    subscription,
+	}
+	txConfirmedPayload := TxConfirmedPayload{
+		Template: notify.NOTIFICATION_TX_CONFIRMED,
+		Data: struct {
+			TxID string "json:\"tx_id\" binding:\"required\""
+		}{
+			TxID: "1234",
+		},
+	}
+	body, err := json.Marshal(txConfirmedPayload)
+	if err != nil {
+		t.Fatalf("failed to marshal notification %v", err)
+	}
+	expected := txConfirmedPayload.ToNotification(&query)
+	testValidNotification(t, "/api/v1/notify?platform=web&token="+url.QueryEscape(subscription), body, expected)
+}
+
+func TestUnifiedPushHook(t *testing.T) {
+	endpoint := "https://ntfy.example.com/upAbc?up=1"
+	query := MobilePushWebHookQuery{
+		Platform: "unifiedpush",
+		Token:    endpoint,
+	}
+	txConfirmedPayload := TxConfirmedPayload{
+		Template: notify.NOTIFICATION_TX_CONFIRMED,
+		Data: struct {
+			TxID string "json:\"tx_id\" binding:\"required\""
+		}{
+			TxID: "1234",
+		},
+	}
+	body, err := json.Marshal(txConfirmedPayload)
+	if err != nil {
+		t.Fatalf("failed to marshal notification %v", err)
+	}
+	expected := txConfirmedPayload.ToNotification(&query)
+	testValidNotification(t, "/api/v1/notify?platform=unifiedpush&token="+url.QueryEscape(endpoint), body, expected)
+}
+
+func TestHuaweiHook(t *testing.T) {
+	query := MobilePushWebHookQuery{
+		Platform: "huawei",
+		Token:    "1234",
+	}
+	paymentReceivedPayload := PaymentReceivedPayload{
+		Template: notify.NOTIFICATION_PAYMENT_RECEIVED,
+		Data: struct {
+			PaymentHash string "json:\"payment_hash\" binding:\"required\""
+		}{
+			PaymentHash: "1234",
+		},
+	}
+	body, err := json.Marshal(paymentReceivedPayload)
+	if err != nil {
+		t.Fatalf("failed to marshal notification %v", err)
+	}
+	expected := paymentReceivedPayload.ToNotification(&query)
+	testValidNotification(t, "/api/v1/notify?platform=huawei&token=1234", body, expected)
+}
+
+func TestUnconfiguredPlatform(t *testing.T) {
+	config := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": newTestService()})
+	channel := channel.NewHttpCallbackChannel("http://localhost:8080")
+	router := setupRouter(notifier, channel, &config.HTTPConfig)
+
+	body := []byte(`{"template": "payment_received", "data": {"payment_hash": "1234"}}`)
+	for _, platform := range []string{"huawei", "webhook", "unknown"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform="+platform+"&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 400, w.Code, platform)
+	}
+}
+
 func testValidNotification(t *testing.T, url string, body []byte, expected *notify.Notification) {
 	service := newTestService()
 	config := &config.Config{WorkersNum: 2}
-	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service})
+	notifier := notify.NewNotifier(config, map[string]notify.Service{expected.Type: service})
 	channel := channel.NewHttpCallbackChannel("http://localhost:8080")
-	router := setupRouter(notifier, channel)
+	router := setupRouter(notifier, channel, &config.HTTPConfig)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
@@ -109,3 +203,354 @@ func (t *TestService) Send(c context.Context, notification *notify.Notification)
 	t.sentQueue <- notification
 	return nil
 }
+
+func TestLive(t *testing.T) {
+	secret := []byte("secret")
+	live := services.NewLive(services.LiveConfig{Secret: secret})
+	config := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"live": live})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig, WithLive(live))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer live.Close()
+
+	res, err := http.Get(server.URL + "/api/v1/live/id1?token=wrong")
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, http.StatusUnauthorized)
+
+	notifyLive := func(identifier string) string {
+		body := `{"template":"payment_received","data":{"payment_hash":"` + identifier + `"}}`
+		res, err := http.Post(server.URL+"/api/v1/notify?platform=live&token="+identifier, "application/json", strings.NewReader(body))
+		assert.NilError(t, err)
+		res.Body.Close()
+		assert.Equal(t, res.StatusCode, http.StatusOK)
+		return res.Header.Get(deliveryIDHeader)
+	}
+
+	// Server-sent events, with the message buffered before the client
+	// connects.
+	deliveryID := notifyLive("id1")
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/live/id1", nil)
+	req.Header.Set("Authorization", "Bearer "+services.LiveToken(secret, "id1"))
+	res, err = http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, res.Header.Get("Content-Type"), "text/event-stream")
+	reader := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		assert.NilError(t, err)
+		lines = append(lines, strings.TrimSpace(line))
+	}
+	assert.Equal(t, lines[0], "id: "+deliveryID)
+	assert.Equal(t, lines[1], "event: notification")
+	var message services.WebhookEnvelope
+	assert.NilError(t, json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &message))
+	assert.Equal(t, message.DeliveryID, deliveryID)
+	assert.Equal(t, message.Template, notify.NOTIFICATION_PAYMENT_RECEIVED)
+
+	// WebSocket.
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/live/id2?token="+services.LiveToken(secret, "id2"), "", "http://localhost/")
+	assert.NilError(t, err)
+	defer ws.Close()
+	for live.Connections() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	deliveryID = notifyLive("id2")
+	assert.NilError(t, websocket.JSON.Receive(ws, &message))
+	assert.Equal(t, message.DeliveryID, deliveryID)
+	assert.DeepEqual(t, message.Data, map[string]interface{}{"payment_hash": "id2"})
+}
+
+func TestRunDrainsBeforeClosingLive(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	secret := []byte("secret")
+	live := services.NewLive(services.LiveConfig{Secret: secret})
+	config := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{Address: address}}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"live": live})
+	// The notification still queued on shutdown is written to the live
+	// connection before it is closed.
+	drain := func() {
+		_, err := notifier.Notify(context.Background(), &notify.Notification{Template: "t1", Type: "live", TargetIdentifier: "id1"})
+		assert.NilError(t, err)
+		assert.NilError(t, notifier.Shutdown(context.Background()))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Run(ctx, notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig, WithLive(live), WithDrain(drain))
+	}()
+
+	var res *http.Response
+	for i := 0; i < 50; i++ {
+		if res, err = http.Get("http://" + address + "/api/v1/live/id1?token=" + services.LiveToken(secret, "id1")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	for live.Connections() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+
+	body, err := io.ReadAll(res.Body)
+	assert.NilError(t, err)
+	assert.Assert(t, strings.Contains(string(body), `"template":"t1"`), string(body))
+	assert.NilError(t, <-stopped)
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	config := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{AdminToken: "secret"}}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{}, notify.WithDeadLetterStore(store.NewMemoryStore()))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/admin/deadletters", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/admin/deadletters", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "[]", w.Body.String())
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/admin/deadletters/unknown", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service}, notify.WithDeliveryStore(store.NewMemoryStore()))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig)
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"template": "tx_confirmed", "data": {"tx_id": "1234"}}`)
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var res struct {
+		DeliveryID string `json:"delivery_id"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, res.DeliveryID, w.Header().Get(deliveryIDHeader))
+	<-service.sentQueue
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/deliveries/"+res.DeliveryID, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var delivery notify.Delivery
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &delivery))
+	assert.Equal(t, delivery.ID, res.DeliveryID)
+	assert.Equal(t, delivery.Template, notify.NOTIFICATION_TX_CONFIRMED)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/api/v1/deliveries/unknown", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestIdempotentWebhooks(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{IdempotencyWindow: time.Minute}}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig)
+
+	post := func(url string, body string, idempotencyKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, bytes.NewBufferString(body))
+		if idempotencyKey != "" {
+			req.Header.Set(idempotencyKeyHeader, idempotencyKey)
+		}
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return w
+	}
+
+	// The natural key of payment_received is its payment hash.
+	paymentReceived := `{"template": "payment_received", "data": {"payment_hash": "1234"}}`
+	first := post("/api/v1/notify?platform=android&token=1234", paymentReceived, "")
+	second := post("/api/v1/notify?platform=android&token=1234", paymentReceived, "")
+	assert.Equal(t, second.Body.String(), first.Body.String())
+	assert.Equal(t, second.Header().Get(idempotentReplayedHeader), "true")
+	// Another token is another notification.
+	post("/api/v1/notify?platform=android&token=5678", paymentReceived, "")
+
+	// Without a natural key only the Idempotency-Key header deduplicates.
+	addressTxsConfirmed := `{"template": "address_txs_confirmed", "data": {"address": "1234"}}`
+	post("/api/v1/notify?platform=android&token=1234", addressTxsConfirmed, "")
+	post("/api/v1/notify?platform=android&token=1234", addressTxsConfirmed, "")
+	post("/api/v1/notify?platform=android&token=1234", addressTxsConfirmed, "key1")
+	post("/api/v1/notify?platform=android&token=1234", addressTxsConfirmed, "key1")
+
+	for i := 0; i < 5; i++ {
+		<-service.sentQueue
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestScheduledWebhook(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{AdminToken: "secret"}}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig)
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"template": "tx_confirmed", "data": {"tx_id": "1234"}}`)
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&delay=1h", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	var res struct {
+		DeliveryID string    `json:"delivery_id"`
+		SendAt     time.Time `json:"send_at"`
+	}
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Assert(t, time.Until(res.SendAt) > 59*time.Minute)
+	scheduled := notifier.Scheduled()
+	assert.Equal(t, len(scheduled), 1)
+	assert.Equal(t, scheduled[0].ID, res.DeliveryID)
+
+	// Only the admins can cancel it.
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/admin/scheduled/"+res.DeliveryID, nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/api/v1/admin/scheduled/"+res.DeliveryID, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, len(notifier.Scheduled()), 0)
+
+	// Notifications waiting for a reply can't be scheduled.
+	w = httptest.NewRecorder()
+	body = []byte(`{"event": "invoice.request", "data": {"offer": "lno1", "invoiceRequest": "lnr1"}}`)
+	req, _ = http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&send_at=2030-01-01T00:00:00Z", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestBlockedTokenWebhook(t *testing.T) {
+	blocklist := store.NewMemoryStore()
+	assert.NilError(t, blocklist.BlockToken("android", "1234", "not registered"))
+	config := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": newTestService()}, notify.WithTokenBlocklist(blocklist))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig)
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"template": "tx_confirmed", "data": {"tx_id": "1234"}}`)
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 410, w.Code)
+}
+
+func TestMetrics(t *testing.T) {
+	service := newTestService()
+	metrics := NewMetrics()
+	config := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service}, notify.WithMiddlewares(notify.Metrics(metrics)))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig, WithMetrics(metrics))
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"template": "tx_confirmed", "data": {"tx_id": "1234"}}`)
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	<-service.sentQueue
+
+	// The send is recorded once the service returned.
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/metrics", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return w.Body.String()
+	}
+	sent := `notify_sends_total{platform="android",result="success",service="android",template="tx_confirmed"} 1`
+	var metricsBody string
+	for i := 0; i < 100 && !strings.Contains(metricsBody, sent); i++ {
+		time.Sleep(10 * time.Millisecond)
+		metricsBody = scrape()
+	}
+	for _, line := range []string{
+		sent,
+		`notify_send_duration_seconds_count{platform="android",service="android",template="tx_confirmed"} 1`,
+		`notify_webhooks_total{code="200",platform="android",template="tx_confirmed"} 1`,
+		`notify_queue_length{priority="normal"} 0`,
+		`notify_pending_callbacks 0`,
+	} {
+		assert.Assert(t, strings.Contains(metricsBody, line), line)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig)
+
+	webhook := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		body := []byte(`{"event": "invoice.request", "data": {"offer": "lno1", "invoiceRequest": "lnr1"}}`)
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(webhook, req)
+		close(done)
+	}()
+
+	// The device replies to the reply url, which carries the trace context.
+	replyURL, err := url.Parse((<-service.sentQueue).Data["reply_url"].(string))
+	assert.NilError(t, err)
+	assert.Assert(t, replyURL.Query().Get("traceparent") != "")
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", replyURL.RequestURI(), bytes.NewBufferString(`{"invoice": "lni1"}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	<-done
+	assert.Equal(t, 200, webhook.Code)
+	assert.Equal(t, webhook.Body.String(), `{"invoice": "lni1"}`)
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root := spans["POST /api/v1/notify"]
+	assert.Assert(t, root != nil)
+	for _, name := range []string{
+		"HttpCallbackChannel.Notify",
+		"Notifier.Notify",
+		"Notifier.process",
+		"Service.Send",
+		"POST /api/v1/response/:responseId",
+		"HttpCallbackChannel.OnResponse",
+	} {
+		span, ok := spans[name]
+		assert.Assert(t, ok, name)
+		assert.Equal(t, span.SpanContext().TraceID(), root.SpanContext().TraceID(), name)
+	}
+	assert.Equal(t, spans["POST /api/v1/response/:responseId"].Parent().SpanID(), spans["HttpCallbackChannel.Notify"].SpanContext().SpanID())
+}
@@ -0,0 +1,61 @@
+package http
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/breez/notify/http"
+
+// tracing starts a span for every request, continuing the trace found in the
+// request headers or, for the device replies, in the reply url.
+func tracing() gin.HandlerFunc {
+	tracer := otel.Tracer(tracerName)
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), &requestCarrier{c.Request})
+		route := c.FullPath()
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethodKey.String(c.Request.Method),
+				semconv.HTTPRouteKey.String(route),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
+
+// requestCarrier reads the trace context from the headers of a request, or
+// from its query string when the headers don't have it.
+type requestCarrier struct {
+	req *http.Request
+}
+
+func (r *requestCarrier) Get(key string) string {
+	if value := r.req.Header.Get(key); value != "" {
+		return value
+	}
+	return r.req.URL.Query().Get(key)
+}
+
+func (r *requestCarrier) Set(key string, value string) {
+	r.req.Header.Set(key, value)
+}
+
+func (r *requestCarrier) Keys() []string {
+	return propagation.HeaderCarrier(r.req.Header).Keys()
+}
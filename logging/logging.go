@@ -0,0 +1,104 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+const redacted = "[redacted]"
+
+// TokenKeys are the attribute keys holding push tokens. Their values are
+// hashed, so the logs of the same token can still be correlated.
+var TokenKeys = []string{"token", "target_identifier", "target_identifiers"}
+
+// DefaultRedactKeys are the attribute keys masked by default: the app data
+// and the notification data that identify a payment or its parties.
+var DefaultRedactKeys = []string{
+	"app_data",
+	"payment_hash",
+	"comment",
+	"nostr",
+	"offer",
+	"invoice_request",
+	"callback_url",
+	"reply_url",
+	"verify_url",
+	"event",
+	"address",
+	"tx_id",
+}
+
+// Redactor rewrites the attributes of the log records that would leak
+// tokens or payment details.
+type Redactor struct {
+	tokens map[string]bool
+	masked map[string]bool
+}
+
+// NewRedactor returns a Redactor that hashes the TokenKeys and masks the
+// given keys, wherever they appear in a record, including in groups.
+func NewRedactor(maskedKeys ...string) *Redactor {
+	r := &Redactor{
+		tokens: make(map[string]bool),
+		masked: make(map[string]bool),
+	}
+	for _, key := range TokenKeys {
+		r.tokens[key] = true
+	}
+	for _, key := range maskedKeys {
+		r.masked[key] = true
+	}
+	return r
+}
+
+// ReplaceAttr is a slog.HandlerOptions.ReplaceAttr redacting the attribute.
+func (r *Redactor) ReplaceAttr(groups []string, a slog.Attr) slog.Attr {
+	switch {
+	case r.tokens[a.Key]:
+		if a.Value.Kind() == slog.KindString {
+			return slog.String(a.Key, HashToken(a.Value.String()))
+		}
+		return slog.String(a.Key, redacted)
+	case r.masked[a.Key]:
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// HashToken returns a short hash of a push token, to identify it in logs
+// without revealing it.
+func HashToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(token))
+	return "sha256:" + hex.EncodeToString(sum[:8])
+}
+
+// New returns a logger writing to w in the given format, "json" or "text",
+// that drops the records below level and redacts them with redactor.
+func New(w io.Writer, format string, level string, redactor *Redactor) (*slog.Logger, error) {
+	var l slog.Level
+	if level != "" {
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %v: %w", level, err)
+		}
+	}
+	opts := slog.HandlerOptions{Level: l}
+	if redactor != nil {
+		opts.ReplaceAttr = redactor.ReplaceAttr
+	}
+	switch strings.ToLower(format) {
+	case "", "json":
+		return slog.New(opts.NewJSONHandler(w)), nil
+	case "text":
+		return slog.New(opts.NewTextHandler(w)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %v", format)
+	}
+}
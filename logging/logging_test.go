@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+	"gotest.tools/v3/assert"
+)
+
+type notification struct{}
+
+func (notification) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("target_identifier", "token1"),
+		slog.String("app_data", "secret"),
+		slog.Group("data",
+			slog.Int("amount", 1000),
+			slog.String("payment_hash", "hash"),
+			slog.String("custom", "value"),
+		),
+	)
+}
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	keys := append(append([]string{}, DefaultRedactKeys...), "custom")
+	logger, err := New(&buf, "json", "info", NewRedactor(keys...))
+	assert.NilError(t, err)
+
+	logger.Info("sent notification", "token", "token2", "notification", notification{})
+	logger.Debug("dropped")
+	assert.Assert(t, !strings.Contains(buf.String(), "token1"))
+	assert.Assert(t, !strings.Contains(buf.String(), "dropped"))
+
+	var record map[string]interface{}
+	assert.NilError(t, json.Unmarshal(buf.Bytes(), &record))
+	assert.Equal(t, record["msg"], "sent notification")
+	assert.Equal(t, record["token"], HashToken("token2"))
+	assert.DeepEqual(t, record["notification"], map[string]interface{}{
+		"target_identifier": HashToken("token1"),
+		"app_data":          redacted,
+		"data": map[string]interface{}{
+			"amount":       float64(1000),
+			"payment_hash": redacted,
+			"custom":       redacted,
+		},
+	})
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "xml", "", nil)
+	assert.ErrorContains(t, err, "unknown log format")
+	_, err = New(&bytes.Buffer{}, "text", "verbose", nil)
+	assert.ErrorContains(t, err, "invalid log level")
+}
@@ -0,0 +1,216 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrCircuitOpen is returned without calling the service while its
+	// circuit breaker is open. It is retryable, so the notification is
+	// retried later or sent through a fallback service.
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+
+	ErrCircuitNotFound = errors.New("circuit breaker not found")
+)
+
+type CircuitState string
+
+const (
+	CircuitClosed   CircuitState = "closed"
+	CircuitOpen     CircuitState = "open"
+	CircuitHalfOpen CircuitState = "half_open"
+)
+
+// BreakerPolicy configures the circuit breaker of a service.
+type BreakerPolicy struct {
+	// FailureThreshold is the number of consecutive failed sends that opens
+	// the circuit. Defaults to 5.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before letting probes
+	// through. Defaults to 30 seconds.
+	OpenTimeout time.Duration
+	// HalfOpenRequests is the number of probes let through when half open.
+	// The circuit closes once all of them succeed and opens again as soon
+	// as one fails. Defaults to 1.
+	HalfOpenRequests int
+}
+
+var DefaultBreakerPolicy = BreakerPolicy{
+	FailureThreshold: 5,
+	OpenTimeout:      30 * time.Second,
+	HalfOpenRequests: 1,
+}
+
+// Circuit is the state of the circuit breaker of a service.
+type Circuit struct {
+	Service  string       `json:"service"`
+	State    CircuitState `json:"state"`
+	Failures int          `json:"failures"`
+	OpenedAt *time.Time   `json:"opened_at,omitempty"`
+}
+
+// WithCircuitBreaker puts a circuit breaker in front of the service of the
+// given service type. Zero fields of the policy take the values of
+// DefaultBreakerPolicy.
+func WithCircuitBreaker(serviceType string, policy BreakerPolicy) Option {
+	return func(n *Notifier) {
+		if policy.FailureThreshold <= 0 {
+			policy.FailureThreshold = DefaultBreakerPolicy.FailureThreshold
+		}
+		if policy.OpenTimeout <= 0 {
+			policy.OpenTimeout = DefaultBreakerPolicy.OpenTimeout
+		}
+		if policy.HalfOpenRequests <= 0 {
+			policy.HalfOpenRequests = DefaultBreakerPolicy.HalfOpenRequests
+		}
+		n.breakers[serviceType] = &circuitBreaker{policy: policy, state: CircuitClosed}
+	}
+}
+
+// Circuits returns the state of the circuit breakers, sorted by service.
+func (n *Notifier) Circuits() []*Circuit {
+	circuits := make([]*Circuit, 0, len(n.breakers))
+	for serviceType, b := range n.breakers {
+		circuits = append(circuits, b.circuit(serviceType))
+	}
+	sort.Slice(circuits, func(i, j int) bool {
+		return circuits[i].Service < circuits[j].Service
+	})
+	return circuits
+}
+
+// ResetCircuit closes the circuit breaker of the service type.
+func (n *Notifier) ResetCircuit(serviceType string) error {
+	b, ok := n.breakers[serviceType]
+	if !ok {
+		return ErrCircuitNotFound
+	}
+	b.reset()
+	n.logger.Info("circuit breaker reset", "service", serviceType)
+	return nil
+}
+
+// sendGuarded sends the notification through the circuit breaker of the
+// service, if it has one.
+func (n *Notifier) sendGuarded(ctx context.Context, serviceType string, request *Notification) error {
+	b, ok := n.breakers[serviceType]
+	if !ok {
+		return n.sendTargets(ctx, serviceType, request)
+	}
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := n.sendTargets(ctx, serviceType, request)
+	if state, changed := b.record(serviceFailed(err)); changed {
+		Logger(ctx).Warn("circuit breaker changed state", "service", serviceType, "state", state, "error", err)
+	}
+	return err
+}
+
+// serviceFailed reports whether err means the service is unhealthy, rather
+// than the notification or its targets being invalid.
+func serviceFailed(err error) bool {
+	if merr, ok := err.(*MulticastError); ok {
+		if len(merr.Sent) > 0 {
+			return false
+		}
+		for _, f := range merr.Failed {
+			if serviceFailed(f.Err) {
+				return true
+			}
+		}
+		return false
+	}
+	return err != nil && IsRetryable(err) && !IsInvalidToken(err) && !errors.Is(err, context.Canceled)
+}
+
+type circuitBreaker struct {
+	mu        sync.Mutex
+	policy    BreakerPolicy
+	state     CircuitState
+	failures  int
+	openedAt  time.Time
+	probes    int
+	successes int
+}
+
+// allow returns ErrCircuitOpen when the send should not reach the service.
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == CircuitOpen {
+		if time.Since(b.openedAt) < b.policy.OpenTimeout {
+			return ErrCircuitOpen
+		}
+		b.state = CircuitHalfOpen
+		b.probes = 0
+		b.successes = 0
+	}
+	if b.state == CircuitHalfOpen {
+		if b.probes >= b.policy.HalfOpenRequests {
+			return ErrCircuitOpen
+		}
+		b.probes++
+	}
+	return nil
+}
+
+// record accounts the result of a send the breaker allowed. It returns the
+// new state and whether it changed.
+func (b *circuitBreaker) record(failed bool) (CircuitState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	previous := b.state
+	switch b.state {
+	case CircuitClosed:
+		if !failed {
+			b.failures = 0
+			break
+		}
+		b.failures++
+		if b.failures >= b.policy.FailureThreshold {
+			b.open()
+		}
+	case CircuitHalfOpen:
+		if failed {
+			b.failures++
+			b.open()
+			break
+		}
+		b.successes++
+		if b.successes >= b.policy.HalfOpenRequests {
+			b.state = CircuitClosed
+			b.failures = 0
+		}
+	}
+	// The results of the sends that started before the circuit opened are
+	// ignored.
+	return b.state, b.state != previous
+}
+
+func (b *circuitBreaker) open() {
+	b.state = CircuitOpen
+	b.openedAt = time.Now()
+}
+
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = CircuitClosed
+	b.failures = 0
+}
+
+func (b *circuitBreaker) circuit(serviceType string) *Circuit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c := &Circuit{Service: serviceType, State: b.state, Failures: b.failures}
+	if b.state != CircuitClosed {
+		openedAt := b.openedAt.UTC()
+		c.OpenedAt = &openedAt
+	}
+	return c
+}
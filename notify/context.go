@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	tenantKey
+	serviceTypeKey
+	loggerKey
+	deliveryIDKey
+	attemptKey
+)
+
+// WithRequestID returns a context carrying the id of the request that
+// triggered the notification.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey, requestID)
+}
+
+// RequestID returns the request id carried by ctx, if any.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey).(string)
+	return requestID
+}
+
+// WithTenant returns a context carrying the tenant the notification is sent
+// on behalf of.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey, tenant)
+}
+
+// Tenant returns the tenant carried by ctx, if any.
+func Tenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey).(string)
+	return tenant
+}
+
+// ServiceType returns the type of the service the notification is being
+// sent with, as set by the Notifier for the middlewares. It differs from the
+// Type of the notification when it is sent by a fallback.
+func ServiceType(ctx context.Context) string {
+	serviceType, _ := ctx.Value(serviceTypeKey).(string)
+	return serviceType
+}
+
+// DeliveryID returns the delivery id of the notification being sent, as set
+// by the Notifier for the middlewares and services.
+func DeliveryID(ctx context.Context) string {
+	deliveryID, _ := ctx.Value(deliveryIDKey).(string)
+	return deliveryID
+}
+
+// Attempt returns the number of the attempt to send the notification, 1 for
+// the first one, as set by the Notifier for the middlewares and services.
+func Attempt(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptKey).(int)
+	return attempt
+}
+
+// detach returns a context that carries the request-scoped values of ctx but
+// not its cancellation or deadline. Notify runs the send after the caller,
+// typically an http handler, has returned, so the caller's context must not
+// be used directly.
+func detach(ctx context.Context) context.Context {
+	detached := context.Background()
+	if requestID := RequestID(ctx); requestID != "" {
+		detached = WithRequestID(detached, requestID)
+	}
+	if tenant := Tenant(ctx); tenant != "" {
+		detached = WithTenant(detached, tenant)
+	}
+	// The spans of the send continue the trace of the caller.
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		detached = trace.ContextWithSpanContext(detached, spanContext)
+	}
+	return detached
+}
+
+// WithSendTimeout sets the deadline of every send that doesn't have a more
+// specific one.
+func WithSendTimeout(timeout time.Duration) Option {
+	return func(n *Notifier) {
+		n.sendTimeout = timeout
+	}
+}
+
+// WithServiceSendTimeout sets the deadline of the sends to the given service
+// type.
+func WithServiceSendTimeout(serviceType string, timeout time.Duration) Option {
+	return func(n *Notifier) {
+		n.serviceSendTimeouts[serviceType] = timeout
+	}
+}
+
+// WithTemplateSendTimeout sets the deadline of the sends of the given
+// template. It takes precedence over the service deadline.
+func WithTemplateSendTimeout(template string, timeout time.Duration) Option {
+	return func(n *Notifier) {
+		n.templateSendTimeouts[template] = timeout
+	}
+}
+
+func (n *Notifier) sendContext(t *task) (context.Context, context.CancelFunc) {
+	timeout, ok := n.templateSendTimeouts[t.notification.Template]
+	if !ok {
+		timeout, ok = n.serviceSendTimeouts[t.notification.Type]
+	}
+	if !ok {
+		timeout = n.sendTimeout
+	}
+	if timeout <= 0 {
+		return context.WithCancel(t.ctx)
+	}
+	return context.WithTimeout(t.ctx, timeout)
+}
@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	ErrDeadLetterNotFound    = errors.New("dead letter not found")
+	ErrDeadLettersNotEnabled = errors.New("dead letter store is not configured")
+)
+
+// DeadLetter is a notification that could not be delivered.
+type DeadLetter struct {
+	ID           string        `json:"id"`
+	Notification *Notification `json:"notification"`
+	Attempts     int           `json:"attempts"`
+	LastError    string        `json:"last_error"`
+	FailedAt     time.Time     `json:"failed_at"`
+}
+
+// DeadLetterStore keeps the notifications that exhausted their retries.
+type DeadLetterStore interface {
+	AddDeadLetter(letter *DeadLetter) error
+	// DeadLetters returns all dead letters ordered by id.
+	DeadLetters() ([]*DeadLetter, error)
+	// DeadLetter returns ErrDeadLetterNotFound for unknown ids.
+	DeadLetter(id string) (*DeadLetter, error)
+	RemoveDeadLetter(id string) error
+}
+
+func (n *Notifier) deadLetter(t *task, err error) {
+	defer n.done(t)
+	if n.deadLetters == nil {
+		n.setState(t, DeliveryFailed, err)
+		return
+	}
+	letter := &DeadLetter{
+		ID:           t.id,
+		Notification: t.notification,
+		Attempts:     t.attempts,
+		LastError:    err.Error(),
+		FailedAt:     time.Now().UTC(),
+	}
+	if storeErr := n.deadLetters.AddDeadLetter(letter); storeErr != nil {
+		n.log(t.ctx).Error("failed to add dead letter", "delivery_id", t.id, "error", storeErr)
+		n.setState(t, DeliveryFailed, err)
+		return
+	}
+	n.setState(t, DeliveryDeadLettered, err)
+	n.log(t.ctx).Info("moved notification to dead letters", "delivery_id", t.id, "attempts", t.attempts)
+}
+
+// DeadLetters lists the notifications that exhausted their retries.
+func (n *Notifier) DeadLetters() ([]*DeadLetter, error) {
+	if n.deadLetters == nil {
+		return nil, ErrDeadLettersNotEnabled
+	}
+	return n.deadLetters.DeadLetters()
+}
+
+// DeadLetter returns a single dead letter by id.
+func (n *Notifier) DeadLetter(id string) (*DeadLetter, error) {
+	if n.deadLetters == nil {
+		return nil, ErrDeadLettersNotEnabled
+	}
+	return n.deadLetters.DeadLetter(id)
+}
+
+// Requeue removes the dead letter and notifies it again as a new
+// notification. It returns the id of the new delivery.
+func (n *Notifier) Requeue(c context.Context, id string) (string, error) {
+	letter, err := n.DeadLetter(id)
+	if err != nil {
+		return "", err
+	}
+	deliveryID, err := n.Notify(c, letter.Notification)
+	if err != nil {
+		return "", err
+	}
+	return deliveryID, n.deadLetters.RemoveDeadLetter(id)
+}
@@ -0,0 +1,117 @@
+package notify
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+var (
+	ErrDeliveryNotFound     = errors.New("delivery not found")
+	ErrDeliveriesNotEnabled = errors.New("delivery store is not configured")
+)
+
+type DeliveryState string
+
+const (
+	// DeliveryScheduled waits for the time it was scheduled at.
+	DeliveryScheduled DeliveryState = "scheduled"
+	// DeliveryCanceled was scheduled and canceled before it was sent.
+	DeliveryCanceled DeliveryState = "canceled"
+	// DeliveryQueued is waiting for a worker, either for the first time or
+	// for a retry after a failed attempt.
+	DeliveryQueued DeliveryState = "queued"
+	// DeliverySending is being handed to the service.
+	DeliverySending DeliveryState = "sending"
+	// DeliverySent was accepted by the service.
+	DeliverySent DeliveryState = "sent"
+	// DeliveryFailed could not be delivered and will not be retried.
+	DeliveryFailed DeliveryState = "failed"
+	// DeliveryDeadLettered could not be delivered and was moved to the dead
+	// letter store.
+	DeliveryDeadLettered DeliveryState = "dead_lettered"
+)
+
+// Delivery is the status of a single notification passed to Notify.
+type Delivery struct {
+	ID        string        `json:"id"`
+	Template  string        `json:"template"`
+	Type      string        `json:"type"`
+	State     DeliveryState `json:"state"`
+	Attempts  int           `json:"attempts"`
+	LastError string        `json:"last_error,omitempty"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	// Service is the service type that delivered the notification, which
+	// differs from Type when it was sent by a fallback. Multicast
+	// notifications record it per target.
+	Service string `json:"service,omitempty"`
+	// Targets is the state of every target of a multicast notification.
+	Targets []*TargetResult `json:"targets,omitempty"`
+}
+
+// DeliveryStore keeps the status of the deliveries.
+type DeliveryStore interface {
+	SaveDelivery(delivery *Delivery) error
+	// Delivery returns ErrDeliveryNotFound for unknown ids.
+	Delivery(id string) (*Delivery, error)
+}
+
+// WithDeliveryStore makes the Notifier record the state of every delivery.
+func WithDeliveryStore(store DeliveryStore) Option {
+	return func(n *Notifier) {
+		n.deliveries = store
+	}
+}
+
+// Delivery returns the status of the delivery with the given id, as returned
+// by Notify.
+func (n *Notifier) Delivery(id string) (*Delivery, error) {
+	if n.deliveries == nil {
+		return nil, ErrDeliveriesNotEnabled
+	}
+	return n.deliveries.Delivery(id)
+}
+
+func (n *Notifier) setState(t *task, state DeliveryState, err error) {
+	if n.deliveries == nil {
+		return
+	}
+	delivery := &Delivery{
+		ID:        t.id,
+		Template:  t.notification.Template,
+		Type:      t.notification.Type,
+		State:     state,
+		Attempts:  t.attempts,
+		CreatedAt: IDTime(t.id),
+		UpdatedAt: time.Now().UTC(),
+		Targets:   n.targetResults(t),
+	}
+	if !t.notification.isMulticast() && state == DeliverySent {
+		delivery.Service = t.services[t.notification.TargetIdentifier]
+	}
+	if err != nil {
+		delivery.LastError = err.Error()
+	}
+	if err := n.deliveries.SaveDelivery(delivery); err != nil {
+		n.logger.Error("failed to save delivery", "delivery_id", t.id, "state", state, "error", err)
+	}
+}
+
+// IDTime returns the time a delivery id was created at.
+func IDTime(id string) time.Time {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) < 8 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))).UTC()
+}
+
+// IDPrefix returns the smallest id created at t, so that ids can be
+// compared with it to find the ones created before t.
+func IDPrefix(t time.Time) string {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,100 @@
+package notify
+
+import (
+	"context"
+	"errors"
+)
+
+// WithFallback sets the services tried, in order, when sending a
+// notification of the given service type fails with an error the fallback
+// policy accepts. The fallbacks are service types of the services passed to
+// NewNotifier.
+func WithFallback(serviceType string, fallbacks ...string) Option {
+	return func(n *Notifier) {
+		n.fallbacks[serviceType] = fallbacks
+	}
+}
+
+// WithFallbackPolicy sets the errors that move a send on to the next service
+// of its fallback chain. Defaults to ShouldFallback.
+func WithFallbackPolicy(shouldFallback func(error) bool) Option {
+	return func(n *Notifier) {
+		n.shouldFallback = shouldFallback
+	}
+}
+
+// ShouldFallback is the default fallback policy: a missing service and
+// errors that are worth retrying move on to the next service, while
+// permanent errors, like an invalid notification, fail right away.
+func ShouldFallback(err error) bool {
+	return errors.Is(err, ErrServiceNotFound) || IsRetryable(err)
+}
+
+// sendChain sends the notification of the task through its service and
+// its fallbacks. It records the service that delivered every target in
+// t.services.
+func (n *Notifier) sendChain(ctx context.Context, t *task) error {
+	request := t.notification
+	chain := append([]string{request.Type}, n.fallbacks[request.Type]...)
+	if t.services == nil {
+		t.services = make(map[string]string)
+	}
+	merr := &MulticastError{}
+	var err error
+	for i, serviceType := range chain {
+		if i > 0 {
+			n.log(ctx).Info("falling back to the next service", "delivery_id", t.id, "service", serviceType, "error", err)
+		}
+		if _, ok := n.serviceByType[serviceType]; ok {
+			err = n.send(ctx, serviceType, request)
+		} else {
+			n.log(ctx).Error("could not find service", "service", serviceType)
+			err = ErrServiceNotFound
+		}
+		if err == nil {
+			for _, target := range request.Targets() {
+				t.services[target] = serviceType
+			}
+			merr.Sent = append(merr.Sent, request.Targets()...)
+			break
+		}
+
+		// Only the targets that failed with an error worth falling back on
+		// are sent to the next service.
+		var next []string
+		var failed []*TargetError
+		if targetsErr, ok := err.(*MulticastError); ok {
+			for _, target := range targetsErr.Sent {
+				t.services[target] = serviceType
+			}
+			merr.Sent = append(merr.Sent, targetsErr.Sent...)
+			failed = targetsErr.Failed
+		} else {
+			for _, target := range request.Targets() {
+				failed = append(failed, &TargetError{TargetIdentifier: target, Err: err})
+			}
+		}
+		last := i == len(chain)-1
+		for _, f := range failed {
+			if !last && n.shouldFallback(f.Err) {
+				next = append(next, f.TargetIdentifier)
+				continue
+			}
+			merr.Failed = append(merr.Failed, f)
+		}
+		if len(next) == 0 {
+			break
+		}
+		if request.isMulticast() {
+			request = request.forTargets(next)
+		}
+	}
+
+	if !t.notification.isMulticast() {
+		return err
+	}
+	if len(merr.Failed) == 0 {
+		return nil
+	}
+	return merr
+}
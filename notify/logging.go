@@ -0,0 +1,70 @@
+package notify
+
+import (
+	"context"
+	"sort"
+
+	"golang.org/x/exp/slog"
+)
+
+// WithLogger sets the logger of the Notifier, also passed to the middlewares
+// and services. Defaults to slog.Default().
+func WithLogger(logger *slog.Logger) Option {
+	return func(n *Notifier) {
+		n.logger = logger
+	}
+}
+
+// LogValue logs the notification as a group. The target identifiers, app
+// data and data values are logged under their own keys, so a redacting
+// handler can hash or mask them.
+func (n *Notification) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.String("template", n.Template),
+		slog.String("type", n.Type),
+	}
+	if n.isMulticast() {
+		attrs = append(attrs, slog.Int("targets", len(n.TargetIdentifiers)))
+	} else {
+		attrs = append(attrs, slog.String("target_identifier", n.TargetIdentifier))
+	}
+	if n.AppData != nil {
+		attrs = append(attrs, slog.String("app_data", *n.AppData))
+	}
+	if len(n.Data) > 0 {
+		keys := make([]string, 0, len(n.Data))
+		for key := range n.Data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		data := make([]slog.Attr, 0, len(keys))
+		for _, key := range keys {
+			data = append(data, slog.Any(key, n.Data[key]))
+		}
+		attrs = append(attrs, slog.Attr{Key: "data", Value: slog.GroupValue(data...)})
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// log returns the logger of the Notifier with the request-scoped values of
+// ctx.
+func (n *Notifier) log(ctx context.Context) *slog.Logger {
+	logger := n.logger
+	if requestID := RequestID(ctx); requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	if tenant := Tenant(ctx); tenant != "" {
+		logger = logger.With("tenant", tenant)
+	}
+	return logger
+}
+
+// Logger returns the logger the Notifier passes to the middlewares and
+// services, with the request id, tenant and delivery id of the notification.
+// It is slog.Default() outside of a send.
+func Logger(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ServiceFunc adapts a function to the Service interface.
+type ServiceFunc func(context context.Context, req *Notification) error
+
+func (f ServiceFunc) Send(context context.Context, req *Notification) error {
+	return f(context, req)
+}
+
+// Middleware wraps a Service with a cross-cutting concern.
+type Middleware func(Service) Service
+
+// Chain wraps service with the middlewares. The first middleware is the
+// outermost one, so it sees the notification first.
+func Chain(service Service, middlewares ...Middleware) Service {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		service = middlewares[i](service)
+	}
+	return service
+}
+
+// WithMiddlewares sets the middlewares applied to every service, replacing
+// the default chain which only contains Logging.
+func WithMiddlewares(middlewares ...Middleware) Option {
+	return func(n *Notifier) {
+		n.middlewares = middlewares
+	}
+}
+
+// WithServiceMiddlewares adds middlewares to the given service type. They run
+// inside the ones set with WithMiddlewares.
+func WithServiceMiddlewares(serviceType string, middlewares ...Middleware) Option {
+	return func(n *Notifier) {
+		n.serviceMiddlewares[serviceType] = append(n.serviceMiddlewares[serviceType], middlewares...)
+	}
+}
+
+// applyMiddlewares wraps every service with its middleware chain.
+func (n *Notifier) applyMiddlewares() {
+	services := make(map[string]Service, len(n.serviceByType))
+	for serviceType, service := range n.serviceByType {
+		middlewares := append(append([]Middleware{}, n.middlewares...), n.serviceMiddlewares[serviceType]...)
+		services[serviceType] = Chain(service, middlewares...)
+	}
+	n.serviceByType = services
+}
+
+// Logging logs the outcome of every send.
+func Logging() Middleware {
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) error {
+			logger := Logger(ctx).With("notification", req, "service", ServiceType(ctx))
+			if err := next.Send(ctx, req); err != nil {
+				logger.Error("failed to send notification", "error", err)
+				return err
+			}
+			logger.Info("sent notification")
+			return nil
+		})
+	}
+}
+
+// Recover turns a panic of the service into an error.
+func Recover() Middleware {
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("service panicked: %v", r)
+				}
+			}()
+			return next.Send(ctx, req)
+		})
+	}
+}
+
+// Timeout bounds every send with the given deadline.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next.Send(ctx, req)
+		})
+	}
+}
+
+// RateLimit waits until the limiter allows the send. The limit is shared by
+// every notification passing through the middleware.
+func RateLimit(limit rate.Limit, burst int) Middleware {
+	limiter := rate.NewLimiter(limit, burst)
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) error {
+			if err := limiter.Wait(ctx); err != nil {
+				return fmt.Errorf("rate limit: %w", err)
+			}
+			return next.Send(ctx, req)
+		})
+	}
+}
+
+// Redact removes the given keys from the notification data before it is
+// handed to the service, for data that must not leave this process.
+func Redact(keys ...string) Middleware {
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) error {
+			redacted := *req
+			redacted.Data = make(map[string]interface{}, len(req.Data))
+			for k, v := range req.Data {
+				redacted.Data[k] = v
+			}
+			for _, k := range keys {
+				delete(redacted.Data, k)
+			}
+			return next.Send(ctx, &redacted)
+		})
+	}
+}
+
+// Retry retries failed sends in place, holding the worker while it waits.
+// Prefer WithRetryPolicy, which frees the worker between attempts, unless
+// the attempts must not be interleaved with other notifications.
+func Retry(policy RetryPolicy) Middleware {
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) error {
+			for attempts := 1; ; attempts++ {
+				err := next.Send(ctx, req)
+				if err == nil || !policy.shouldRetry(attempts, err) {
+					return err
+				}
+				select {
+				case <-time.After(policy.backoff(attempts)):
+				case <-ctx.Done():
+					return err
+				}
+			}
+		})
+	}
+}
+
+// MetricsRecorder receives the outcome of the sends passing through the
+// Metrics middleware.
+type MetricsRecorder interface {
+	ObserveSend(ctx context.Context, req *Notification, duration time.Duration, err error)
+}
+
+// Metrics reports the duration and the outcome of every send.
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next Service) Service {
+		return ServiceFunc(func(ctx context.Context, req *Notification) error {
+			start := time.Now()
+			err := next.Send(ctx, req)
+			recorder.ObserveSend(ctx, req, time.Since(start), err)
+			return err
+		})
+	}
+}
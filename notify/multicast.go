@@ -0,0 +1,211 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MulticastService is a Service that sends a notification with many
+// TargetIdentifiers itself, typically through a batch api. For other services
+// the Notifier sends such notifications one target at a time.
+type MulticastService interface {
+	Service
+	SupportsMulticast() bool
+}
+
+// TargetError is the error of a single target of a multicast notification.
+type TargetError struct {
+	TargetIdentifier string
+	Err              error
+}
+
+// MulticastError is returned when sending a multicast notification failed
+// for some of its targets.
+type MulticastError struct {
+	Sent   []string
+	Failed []*TargetError
+}
+
+func (e *MulticastError) Error() string {
+	return fmt.Sprintf("failed to send to %d of %d targets, first error: %v",
+		len(e.Failed), len(e.Sent)+len(e.Failed), e.Failed[0].Err)
+}
+
+// TargetResult is the delivery state of a single target of a multicast
+// notification.
+type TargetResult struct {
+	TargetIdentifier string        `json:"target_identifier"`
+	State            DeliveryState `json:"state"`
+	Error            string        `json:"error,omitempty"`
+	// Service is the service type that delivered the target.
+	Service string `json:"service,omitempty"`
+}
+
+// Targets returns the identifiers the notification is sent to.
+func (n *Notification) Targets() []string {
+	if len(n.TargetIdentifiers) > 0 {
+		return n.TargetIdentifiers
+	}
+	return []string{n.TargetIdentifier}
+}
+
+func (n *Notification) isMulticast() bool {
+	return len(n.TargetIdentifiers) > 0
+}
+
+// forTargets returns a copy of the notification sent to the given targets.
+func (n *Notification) forTargets(targets []string) *Notification {
+	c := *n
+	c.TargetIdentifiers = targets
+	return &c
+}
+
+// send hands the notification to the service, skipping its blocked targets
+// and blocking the ones the service reports invalid.
+func (n *Notifier) send(ctx context.Context, serviceType string, request *Notification) (err error) {
+	ctx = context.WithValue(ctx, serviceTypeKey, serviceType)
+	ctx, span := tracer().Start(ctx, "Service.Send", trace.WithAttributes(
+		AttributeService.String(serviceType),
+		AttributeTemplate.String(request.Template),
+	))
+	defer func() { EndSpan(span, err) }()
+	unblocked, blocked := n.unblocked(request)
+	if len(blocked) == 0 {
+		err := n.sendGuarded(ctx, serviceType, request)
+		n.invalidateTokens(ctx, serviceType, request, err)
+		return err
+	}
+	if !request.isMulticast() {
+		return blocked[0].Err
+	}
+
+	merr := &MulticastError{Failed: blocked}
+	if unblocked != nil {
+		err := n.sendGuarded(ctx, serviceType, unblocked)
+		n.invalidateTokens(ctx, serviceType, unblocked, err)
+		switch err := err.(type) {
+		case nil:
+			merr.Sent = unblocked.Targets()
+		case *MulticastError:
+			merr.Sent = err.Sent
+			merr.Failed = append(merr.Failed, err.Failed...)
+		default:
+			for _, target := range unblocked.Targets() {
+				merr.Failed = append(merr.Failed, &TargetError{TargetIdentifier: target, Err: err})
+			}
+		}
+	}
+	return merr
+}
+
+// sendTargets fans a multicast notification out when the service cannot
+// send it at once.
+func (n *Notifier) sendTargets(ctx context.Context, serviceType string, request *Notification) error {
+	service := n.serviceByType[serviceType]
+	if !request.isMulticast() {
+		return service.Send(ctx, request)
+	}
+	if multicast, ok := n.rawServiceByType[serviceType].(MulticastService); ok && multicast.SupportsMulticast() {
+		return service.Send(ctx, request)
+	}
+
+	merr := &MulticastError{}
+	for _, target := range request.TargetIdentifiers {
+		single := *request
+		single.TargetIdentifier = target
+		single.TargetIdentifiers = nil
+		if err := service.Send(ctx, &single); err != nil {
+			merr.Failed = append(merr.Failed, &TargetError{TargetIdentifier: target, Err: err})
+			continue
+		}
+		merr.Sent = append(merr.Sent, target)
+	}
+	if len(merr.Failed) > 0 {
+		return merr
+	}
+	return nil
+}
+
+// recordTargets updates the per target results of a multicast task after a
+// send. When only some targets failed it narrows the task to the ones worth
+// retrying, and returns the error to classify the task with.
+func (n *Notifier) recordTargets(t *task, err error) error {
+	if !t.notification.isMulticast() {
+		return err
+	}
+	if t.results == nil {
+		t.results = make(map[string]*TargetResult)
+		for _, target := range t.notification.TargetIdentifiers {
+			t.results[target] = &TargetResult{TargetIdentifier: target, State: DeliveryQueued}
+		}
+		t.targets = t.notification.TargetIdentifiers
+	}
+
+	merr, ok := err.(*MulticastError)
+	if !ok {
+		state := DeliverySent
+		errMsg := ""
+		if err != nil {
+			state, errMsg = DeliveryFailed, err.Error()
+		}
+		for _, target := range t.notification.TargetIdentifiers {
+			t.results[target].State = state
+			t.results[target].Error = errMsg
+			t.results[target].Service = t.services[target]
+		}
+		return err
+	}
+
+	var retry []string
+	for _, target := range merr.Sent {
+		t.results[target].State = DeliverySent
+		t.results[target].Error = ""
+		t.results[target].Service = t.services[target]
+	}
+	for _, failed := range merr.Failed {
+		t.results[failed.TargetIdentifier].State = DeliveryFailed
+		t.results[failed.TargetIdentifier].Error = failed.Err.Error()
+		if !IsPermanent(failed.Err) {
+			retry = append(retry, failed.TargetIdentifier)
+		}
+	}
+	if len(retry) == 0 {
+		return Permanent(err)
+	}
+	t.notification = t.notification.forTargets(retry)
+	if n.store != nil {
+		if err := n.store.Save(t.id, t.notification); err != nil {
+			n.log(t.ctx).Error("failed to persist notification targets", "delivery_id", t.id, "error", err)
+		}
+	}
+	return err
+}
+
+func (n *Notifier) targetResults(t *task) []*TargetResult {
+	if t.results == nil {
+		return nil
+	}
+	results := make([]*TargetResult, 0, len(t.targets))
+	for _, target := range t.targets {
+		r := *t.results[target]
+		results = append(results, &r)
+	}
+	return results
+}
+
+// failedTargetsError returns an error when some targets of a multicast task
+// failed.
+func (t *task) failedTargetsError() error {
+	failed := 0
+	for _, r := range t.results {
+		if r.State == DeliveryFailed {
+			failed++
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("failed to send to %d of %d targets", failed, len(t.results))
+}
@@ -2,11 +2,17 @@ package notify
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/breez/notify/config"
-	"github.com/golang-queue/queue"
-	"github.com/google/martian/v3/log"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
 const (
@@ -18,51 +24,358 @@ const (
 	NOTIFICATION_LNURLPAY_VERIFY       = "lnurlpay_verify"
 	NOTIFICATION_SWAP_UPDATED          = "swap_updated"
 	NOTIFICATION_INVOICE_REQUEST       = "invoice_request"
-	NOTIFICATION_NWC_EVENT   		   = "nwc_event"
+	NOTIFICATION_NWC_EVENT             = "nwc_event"
 )
 
 var (
-	ErrServiceNotFound = errors.New("Service not found")
+	ErrServiceNotFound = Permanent(errors.New("Service not found"))
+	ErrShuttingDown    = errors.New("shutting down")
 )
 
 type Notification struct {
-	Template         string
-	DisplayMessage   string
-	Type             string
-	TargetIdentifier string
-	AppData          *string
-	Data             map[string]interface{}
+	Template         string `json:"template"`
+	DisplayMessage   string `json:"display_message"`
+	Type             string `json:"type"`
+	TargetIdentifier string `json:"target_identifier"`
+	// TargetIdentifiers sends the notification to many targets at once,
+	// instead of TargetIdentifier.
+	TargetIdentifiers []string               `json:"target_identifiers,omitempty"`
+	AppData           *string                `json:"app_data,omitempty"`
+	Data              map[string]interface{} `json:"data,omitempty"`
+	// Priority overrides the priority of the template.
+	Priority Priority `json:"priority,omitempty"`
 }
 
 type Service interface {
 	Send(context context.Context, req *Notification) error
 }
 
+// Store persists the notifications accepted by the Notifier until they are
+// handled, so that a restart does not lose them.
+type Store interface {
+	// Save persists the notification under the given id.
+	Save(id string, notification *Notification) error
+	// Delete removes the notification with the given id.
+	Delete(id string) error
+	// Pending returns the saved notifications ordered by id.
+	Pending() ([]*PendingNotification, error)
+}
+
+type PendingNotification struct {
+	ID           string
+	Notification *Notification
+}
+
+type Option func(n *Notifier)
+
+// WithStore makes the Notifier persist every notification before it is
+// queued and replay the ones that were not handled on startup.
+func WithStore(store Store) Option {
+	return func(n *Notifier) {
+		n.store = store
+	}
+}
+
+// WithRetryPolicy sets the retry policy used for notifications of the given
+// service type.
+func WithRetryPolicy(serviceType string, policy RetryPolicy) Option {
+	return func(n *Notifier) {
+		n.retryPolicies[serviceType] = policy
+	}
+}
+
+// WithDefaultRetryPolicy sets the retry policy used for service types that
+// don't have their own.
+func WithDefaultRetryPolicy(policy RetryPolicy) Option {
+	return func(n *Notifier) {
+		n.defaultRetryPolicy = policy
+	}
+}
+
+// WithDeadLetterStore keeps the notifications that exhausted their retries
+// so they can be inspected and requeued.
+func WithDeadLetterStore(store DeadLetterStore) Option {
+	return func(n *Notifier) {
+		n.deadLetters = store
+	}
+}
+
 type Notifier struct {
-	queue         *queue.Queue
-	serviceByType map[string]Service
+	lanes              map[Priority]lane
+	ordered            bool
+	serviceByType      map[string]Service
+	rawServiceByType   map[string]Service
+	store              Store
+	retryPolicies      map[string]RetryPolicy
+	defaultRetryPolicy RetryPolicy
+	fallbacks          map[string][]string
+	shouldFallback     func(error) bool
+	breakers           map[string]*circuitBreaker
+	logger             *slog.Logger
+	blocklist          TokenBlocklist
+	tokenHandlers      []TokenInvalidatedHandler
+	deadLetters        DeadLetterStore
+	deliveries         DeliveryStore
+
+	templatePriorities map[string]Priority
+	middlewares        []Middleware
+	serviceMiddlewares map[string][]Middleware
+
+	sendTimeout          time.Duration
+	serviceSendTimeouts  map[string]time.Duration
+	templateSendTimeouts map[string]time.Duration
+
+	// mu guards closing, so no notification is added to inflight once
+	// Shutdown started waiting for it.
+	mu       sync.RWMutex
+	closing  bool
+	inflight sync.WaitGroup
+
+	scheduleStore ScheduleStore
+	scheduleMu    sync.Mutex
+	scheduled     map[string]*scheduledTimer
 }
 
-func NewNotifier(config *config.Config, services map[string]Service) *Notifier {
-	q := queue.NewPool(config.WorkersNum)
-	return &Notifier{
-		queue:         q,
-		serviceByType: services,
+func NewNotifier(config *config.Config, services map[string]Service, opts ...Option) *Notifier {
+	n := &Notifier{
+		lanes:                newLanes(config),
+		ordered:              config.OrderByTarget,
+		templatePriorities:   make(map[string]Priority),
+		serviceByType:        services,
+		rawServiceByType:     services,
+		retryPolicies:        make(map[string]RetryPolicy),
+		defaultRetryPolicy:   NoRetry,
+		fallbacks:            make(map[string][]string),
+		shouldFallback:       ShouldFallback,
+		breakers:             make(map[string]*circuitBreaker),
+		logger:               slog.Default(),
+		serviceSendTimeouts:  make(map[string]time.Duration),
+		templateSendTimeouts: make(map[string]time.Duration),
+		sendTimeout:          config.SendTimeout,
+		middlewares:          []Middleware{Logging()},
+		serviceMiddlewares:   make(map[string][]Middleware),
+		scheduled:            make(map[string]*scheduledTimer),
 	}
+	for _, opt := range opts {
+		opt(n)
+	}
+	n.applyMiddlewares()
+	n.replay()
+	n.loadScheduled()
+	return n
 }
 
-func (n *Notifier) Notify(c context.Context, request *Notification) error {
-	return n.queue.QueueTask(func(ctx context.Context) error {
-		service, ok := n.serviceByType[request.Type]
-		if !ok {
-			log.Errorf("could not find service %+v %v", request.Type)
-			return ErrServiceNotFound
+// Notify queues the notification and returns its delivery id, which can be
+// passed to Delivery to follow its state.
+func (n *Notifier) Notify(c context.Context, request *Notification) (string, error) {
+	return n.notify(c, newID(), request)
+}
+
+// HasService reports whether the notifications of the given type can be
+// sent, by their own service or one of its fallbacks.
+func (n *Notifier) HasService(notificationType string) bool {
+	for _, serviceType := range append([]string{notificationType}, n.fallbacks[notificationType]...) {
+		if _, ok := n.serviceByType[serviceType]; ok {
+			return true
 		}
-		if err := service.Send(c, request); err != nil {
-			log.Errorf("failed to send notification %+v %v", request, err)
-			return err
+	}
+	return false
+}
+
+func (n *Notifier) notify(c context.Context, id string, request *Notification) (_ string, err error) {
+	c, span := tracer().Start(c, "Notifier.Notify", trace.WithAttributes(
+		AttributeDeliveryID.String(id),
+		AttributeTemplate.String(request.Template),
+		AttributeType.String(request.Type),
+	))
+	defer func() { EndSpan(span, err) }()
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closing {
+		return "", ErrShuttingDown
+	}
+	if !request.isMulticast() && n.IsTokenBlocked(request.Type, request.TargetIdentifier) {
+		return "", ErrTokenBlocked
+	}
+	if n.store != nil {
+		if err := n.store.Save(id, request); err != nil {
+			n.log(c).Error("failed to persist notification", "notification", request, "error", err)
+			return "", fmt.Errorf("failed to persist notification: %w", err)
 		}
-		log.Infof("succeed to send notification %+v", request)
+	}
+	t := &task{id: id, ctx: detach(c), notification: request}
+	n.setState(t, DeliveryQueued, nil)
+	n.inflight.Add(1)
+	if err := n.enqueue(t); err != nil {
+		n.setState(t, DeliveryFailed, err)
+		n.done(t)
+		return "", err
+	}
+	return id, nil
+}
+
+// Shutdown stops accepting notifications and waits until the queued ones are
+// handled or ctx is done, then releases the queues. Notifications that are
+// still pending at that point stay in the store, if there is one, and are
+// replayed by the next Notifier.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.mu.Lock()
+	n.closing = true
+	n.mu.Unlock()
+	n.stopScheduled()
+
+	drained := make(chan struct{})
+	go func() {
+		n.inflight.Wait()
+		for _, lane := range n.lanes {
+			lane.release()
+		}
+		close(drained)
+	}()
+	select {
+	case <-drained:
 		return nil
+	case <-ctx.Done():
+		for _, lane := range n.lanes {
+			lane.shutdown()
+		}
+		return fmt.Errorf("notifications left pending: %w", ctx.Err())
+	}
+}
+
+func (n *Notifier) isClosing() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.closing
+}
+
+// task is a single notification travelling through the queue.
+type task struct {
+	id string
+	// ctx is detached from the context passed to Notify.
+	ctx          context.Context
+	notification *Notification
+	attempts     int
+	// targets and results track the targets of a multicast notification.
+	targets []string
+	results map[string]*TargetResult
+	// services is the service type that delivered each target.
+	services map[string]string
+}
+
+func (n *Notifier) enqueue(t *task) error {
+	key := t.notification.Targets()[0]
+	return n.lane(t.notification).queueTask(key, func(ctx context.Context) error {
+		return n.process(t)
+	})
+}
+
+func (n *Notifier) process(t *task) (err error) {
+	t.attempts++
+	n.setState(t, DeliverySending, nil)
+	ctx, cancel := n.sendContext(t)
+	defer cancel()
+	ctx, span := tracer().Start(ctx, "Notifier.process", trace.WithAttributes(
+		AttributeDeliveryID.String(t.id),
+		AttributeTemplate.String(t.notification.Template),
+		AttributeAttempt.Int(t.attempts),
+	))
+	defer func() { EndSpan(span, err) }()
+	ctx = context.WithValue(ctx, deliveryIDKey, t.id)
+	ctx = context.WithValue(ctx, attemptKey, t.attempts)
+	ctx = context.WithValue(ctx, loggerKey, n.log(ctx).With("delivery_id", t.id, "attempt", t.attempts))
+	err = n.recordTargets(t, n.sendChain(ctx, t))
+	if err != nil {
+		n.fail(t, err)
+		return err
+	}
+	// Targets of a multicast notification that failed permanently at an
+	// earlier attempt are not retried, but still fail the delivery.
+	if err := t.failedTargetsError(); err != nil {
+		n.setState(t, DeliveryFailed, err)
+	} else {
+		n.setState(t, DeliverySent, nil)
+	}
+	n.done(t)
+	return nil
+}
+
+// fail either schedules another attempt for the task according to the
+// retry policy of its service, or moves it to the dead letter store.
+func (n *Notifier) fail(t *task, err error) {
+	policy := n.retryPolicy(t.notification.Type)
+	if !policy.shouldRetry(t.attempts, err) {
+		n.deadLetter(t, err)
+		return
+	}
+	backoff := policy.backoff(t.attempts)
+	n.log(t.ctx).Info("retrying notification", "delivery_id", t.id, "backoff", backoff, "attempt", t.attempts, "error", err)
+	n.setState(t, DeliveryQueued, err)
+	if n.ordered {
+		// Retry in place, so the next notifications for the same target
+		// keep waiting for this one.
+		time.Sleep(backoff)
+		n.process(t)
+		return
+	}
+	time.AfterFunc(backoff, func() {
+		if err := n.enqueue(t); err != nil {
+			if n.isClosing() {
+				n.log(t.ctx).Info("notification left pending on shutdown", "delivery_id", t.id)
+				n.inflight.Done()
+				return
+			}
+			n.log(t.ctx).Error("failed to requeue notification", "delivery_id", t.id, "error", err)
+			n.deadLetter(t, err)
+		}
 	})
 }
+
+// replay queues the notifications left in the store by a previous run.
+func (n *Notifier) replay() {
+	if n.store == nil {
+		return
+	}
+	pending, err := n.store.Pending()
+	if err != nil {
+		n.logger.Error("failed to load pending notifications", "error", err)
+		return
+	}
+	for _, p := range pending {
+		t := &task{id: p.ID, ctx: context.Background(), notification: p.Notification}
+		n.inflight.Add(1)
+		if err := n.enqueue(t); err != nil {
+			n.inflight.Done()
+			n.logger.Error("failed to replay notification", "delivery_id", p.ID, "error", err)
+			continue
+		}
+		n.logger.Info("replayed notification", "delivery_id", p.ID)
+	}
+}
+
+// done marks the task as handled.
+func (n *Notifier) done(t *task) {
+	n.forget(t.id)
+	n.inflight.Done()
+}
+
+func (n *Notifier) forget(id string) {
+	if n.store == nil {
+		return
+	}
+	if err := n.store.Delete(id); err != nil {
+		n.logger.Error("failed to delete notification from store", "delivery_id", id, "error", err)
+	}
+}
+
+// newID returns a random identifier prefixed with the current time, so that
+// ids sort in creation order.
+func newID() string {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+	if _, err := rand.Read(b[8:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -1,10 +1,19 @@
 package notify
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/breez/notify/config"
+	"golang.org/x/exp/slog"
 	"gotest.tools/v3/assert"
 )
 
@@ -39,3 +48,867 @@ func TestNotify(t *testing.T) {
 	assert.Assert(t, len(notifications) == 1)
 	assert.DeepEqual(t, notifications[0], n)
 }
+
+type testStore struct {
+	sync.Mutex
+	notifications map[string]*Notification
+}
+
+func newTestStore() *testStore {
+	return &testStore{notifications: make(map[string]*Notification)}
+}
+
+func (s *testStore) Save(id string, notification *Notification) error {
+	s.Lock()
+	defer s.Unlock()
+	s.notifications[id] = notification
+	return nil
+}
+
+func (s *testStore) Delete(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.notifications, id)
+	return nil
+}
+
+func (s *testStore) Pending() ([]*PendingNotification, error) {
+	s.Lock()
+	defer s.Unlock()
+	var pending []*PendingNotification
+	for id, n := range s.notifications {
+		pending = append(pending, &PendingNotification{ID: id, Notification: n})
+	}
+	return pending, nil
+}
+
+func (s *testStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.notifications)
+}
+
+func TestNotifyReplaysStore(t *testing.T) {
+	store := newTestStore()
+	n := Notification{
+		Template:         "t1",
+		Type:             "test",
+		TargetIdentifier: "token1",
+	}
+	store.Save("1", &n)
+
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2}
+	NewNotifier(config, map[string]Service{"test": service}, WithStore(store))
+
+	res := <-service.sentQueue
+	assert.DeepEqual(t, *res, n)
+	assert.Assert(t, poll(func() bool { return store.Len() == 0 }))
+}
+
+func poll(check func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if check() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+type flakyService struct {
+	*TestService
+	sync.Mutex
+	failures int
+	err      error
+}
+
+func (f *flakyService) Send(c context.Context, notification *Notification) error {
+	f.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.Unlock()
+		return f.err
+	}
+	f.Unlock()
+	return f.TestService.Send(c, notification)
+}
+
+type testDeadLetterStore struct {
+	sync.Mutex
+	letters map[string]*DeadLetter
+}
+
+func (s *testDeadLetterStore) AddDeadLetter(letter *DeadLetter) error {
+	s.Lock()
+	defer s.Unlock()
+	s.letters[letter.ID] = letter
+	return nil
+}
+
+func (s *testDeadLetterStore) DeadLetters() ([]*DeadLetter, error) {
+	s.Lock()
+	defer s.Unlock()
+	var letters []*DeadLetter
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	return letters, nil
+}
+
+func (s *testDeadLetterStore) DeadLetter(id string) (*DeadLetter, error) {
+	s.Lock()
+	defer s.Unlock()
+	letter, ok := s.letters[id]
+	if !ok {
+		return nil, ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+func (s *testDeadLetterStore) RemoveDeadLetter(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.letters, id)
+	return nil
+}
+
+func TestNotifyRetries(t *testing.T) {
+	service := &flakyService{TestService: newTestService(), failures: 2, err: errors.New("unavailable")}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithRetryPolicy("test", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	n := Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"}
+	_, err := notifier.Notify(context.Background(), &n)
+	assert.NilError(t, err)
+
+	res := <-service.sentQueue
+	assert.DeepEqual(t, *res, n)
+}
+
+func TestNotifyDeadLetters(t *testing.T) {
+	service := &flakyService{TestService: newTestService(), failures: 1, err: Permanent(errors.New("invalid token"))}
+	deadLetters := &testDeadLetterStore{letters: make(map[string]*DeadLetter)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithRetryPolicy("test", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+		WithDeadLetterStore(deadLetters))
+	n := Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"}
+	_, err := notifier.Notify(context.Background(), &n)
+	assert.NilError(t, err)
+
+	var letters []*DeadLetter
+	assert.Assert(t, poll(func() bool {
+		letters, _ = notifier.DeadLetters()
+		return len(letters) == 1
+	}))
+	assert.Equal(t, letters[0].Attempts, 1)
+	assert.Equal(t, letters[0].LastError, "invalid token")
+
+	_, err = notifier.Requeue(context.Background(), letters[0].ID)
+	assert.NilError(t, err)
+	res := <-service.sentQueue
+	assert.DeepEqual(t, *res, n)
+	_, err = notifier.DeadLetter(letters[0].ID)
+	assert.ErrorIs(t, err, ErrDeadLetterNotFound)
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}
+	assert.Equal(t, policy.backoff(1), time.Second)
+	assert.Equal(t, policy.backoff(2), 2*time.Second)
+	assert.Equal(t, policy.backoff(3), 3*time.Second)
+	assert.Assert(t, policy.shouldRetry(4, errors.New("transient")))
+	assert.Assert(t, !policy.shouldRetry(5, errors.New("transient")))
+	assert.Assert(t, !policy.shouldRetry(1, Permanent(errors.New("permanent"))))
+}
+
+type testDeliveryStore struct {
+	sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func (s *testDeliveryStore) SaveDelivery(delivery *Delivery) error {
+	s.Lock()
+	defer s.Unlock()
+	s.deliveries[delivery.ID] = delivery
+	return nil
+}
+
+func (s *testDeliveryStore) Delivery(id string) (*Delivery, error) {
+	s.Lock()
+	defer s.Unlock()
+	delivery, ok := s.deliveries[id]
+	if !ok {
+		return nil, ErrDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+func TestDeliveryState(t *testing.T) {
+	service := &flakyService{TestService: newTestService(), failures: 1, err: errors.New("unavailable")}
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service, "broken": &flakyService{failures: 1, err: Permanent(errors.New("invalid token"))}},
+		WithRetryPolicy("test", RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond}),
+		WithDeliveryStore(deliveries))
+
+	id, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	<-service.sentQueue
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(id)
+		return d.State == DeliverySent
+	}))
+	d, _ := notifier.Delivery(id)
+	assert.Equal(t, d.Attempts, 2)
+	assert.Equal(t, d.LastError, "")
+
+	id, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "broken", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(id)
+		return d.State == DeliveryFailed
+	}))
+	d, _ = notifier.Delivery(id)
+	assert.Equal(t, d.LastError, "invalid token")
+
+	_, err = notifier.Delivery("unknown")
+	assert.ErrorIs(t, err, ErrDeliveryNotFound)
+}
+
+func TestShutdown(t *testing.T) {
+	service := &flakyService{TestService: newTestService(), failures: 1, err: errors.New("unavailable")}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithRetryPolicy("test", RetryPolicy{MaxAttempts: 2, InitialBackoff: 50 * time.Millisecond}))
+	_, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+
+	// Shutdown waits for the pending retry.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NilError(t, notifier.Shutdown(ctx))
+	assert.Equal(t, len(service.sentQueue), 1)
+
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+	assert.ErrorIs(t, err, ErrShuttingDown)
+}
+
+type contextService struct {
+	contexts chan context.Context
+	errs     chan error
+}
+
+func (s *contextService) Send(c context.Context, notification *Notification) error {
+	s.contexts <- c
+	s.errs <- c.Err()
+	return nil
+}
+
+func TestNotifyDetachesContext(t *testing.T) {
+	service := &contextService{contexts: make(chan context.Context, 1), errs: make(chan error, 1)}
+	config := &config.Config{WorkersNum: 2, SendTimeout: time.Hour}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithServiceSendTimeout("test", time.Minute),
+		WithTemplateSendTimeout("urgent", time.Second))
+
+	// The caller's context is already canceled, as it is when an http handler returned.
+	ctx, cancel := context.WithCancel(WithTenant(WithRequestID(context.Background(), "req1"), "tenant1"))
+	cancel()
+	_, err := notifier.Notify(ctx, &Notification{Template: "urgent", Type: "test", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+
+	sendCtx := <-service.contexts
+	assert.NilError(t, <-service.errs)
+	assert.Equal(t, RequestID(sendCtx), "req1")
+	assert.Equal(t, Tenant(sendCtx), "tenant1")
+	deadline, ok := sendCtx.Deadline()
+	assert.Assert(t, ok)
+	assert.Assert(t, time.Until(deadline) <= time.Second)
+
+	_, err = notifier.Notify(ctx, &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	sendCtx = <-service.contexts
+	assert.NilError(t, <-service.errs)
+	deadline, _ = sendCtx.Deadline()
+	assert.Assert(t, time.Until(deadline) > time.Second && time.Until(deadline) <= time.Minute)
+}
+
+func TestMiddlewares(t *testing.T) {
+	var calls []string
+	var mu sync.Mutex
+	record := func(name string) Middleware {
+		return func(next Service) Service {
+			return ServiceFunc(func(ctx context.Context, req *Notification) error {
+				mu.Lock()
+				calls = append(calls, name)
+				mu.Unlock()
+				return next.Send(ctx, req)
+			})
+		}
+	}
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithMiddlewares(record("global"), Recover()),
+		WithServiceMiddlewares("test", record("service"), Redact("comment")),
+		WithServiceMiddlewares("other", record("other")))
+	_, err := notifier.Notify(context.Background(), &Notification{
+		Template:         "t1",
+		Type:             "test",
+		TargetIdentifier: "token1",
+		Data:             map[string]interface{}{"amount": 1000, "comment": "secret"},
+	})
+	assert.NilError(t, err)
+
+	res := <-service.sentQueue
+	assert.DeepEqual(t, res.Data, map[string]interface{}{"amount": 1000})
+	mu.Lock()
+	defer mu.Unlock()
+	assert.DeepEqual(t, calls, []string{"global", "service"})
+}
+
+func TestRetryMiddleware(t *testing.T) {
+	service := &flakyService{TestService: newTestService(), failures: 2, err: errors.New("unavailable")}
+	retrying := Chain(service, Retry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	assert.NilError(t, retrying.Send(context.Background(), &Notification{Template: "t1"}))
+	assert.Equal(t, len(service.sentQueue), 1)
+
+	service = &flakyService{TestService: newTestService(), failures: 1, err: Permanent(errors.New("invalid token"))}
+	retrying = Chain(service, Retry(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}))
+	assert.Error(t, retrying.Send(context.Background(), &Notification{Template: "t1"}), "invalid token")
+}
+
+type targetService struct {
+	*TestService
+	sync.Mutex
+	failures map[string]error
+}
+
+func (s *targetService) Send(c context.Context, notification *Notification) error {
+	s.Lock()
+	err, ok := s.failures[notification.TargetIdentifier]
+	delete(s.failures, notification.TargetIdentifier)
+	s.Unlock()
+	if ok {
+		return err
+	}
+	return s.TestService.Send(c, notification)
+}
+
+func TestNotifyMulticastFanOut(t *testing.T) {
+	service := &targetService{TestService: newTestService(), failures: map[string]error{
+		"token2": errors.New("unavailable"),
+		"token3": Permanent(errors.New("invalid token")),
+	}}
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithRetryPolicy("test", RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}),
+		WithDeliveryStore(deliveries))
+
+	id, err := notifier.Notify(context.Background(), &Notification{
+		Template:          "t1",
+		Type:              "test",
+		TargetIdentifiers: []string{"token1", "token2", "token3"},
+	})
+	assert.NilError(t, err)
+
+	var delivery *Delivery
+	assert.Assert(t, poll(func() bool {
+		delivery, _ = notifier.Delivery(id)
+		return delivery.State == DeliveryFailed
+	}))
+	// token1 is sent at the first attempt, token2 at the retry and token3 is never retried.
+	assert.Equal(t, delivery.Attempts, 2)
+	assert.DeepEqual(t, delivery.Targets, []*TargetResult{
+		{TargetIdentifier: "token1", State: DeliverySent, Service: "test"},
+		{TargetIdentifier: "token2", State: DeliverySent, Service: "test"},
+		{TargetIdentifier: "token3", State: DeliveryFailed, Error: "invalid token"},
+	})
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "token1")
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "token2")
+}
+
+type blockingService struct {
+	*TestService
+	block chan struct{}
+}
+
+func (s *blockingService) Send(c context.Context, notification *Notification) error {
+	if notification.Template == "bulk" {
+		<-s.block
+	}
+	return s.TestService.Send(c, notification)
+}
+
+func TestPriorityLanes(t *testing.T) {
+	service := &blockingService{TestService: newTestService(), block: make(chan struct{})}
+	config := &config.Config{WorkersNum: 1, HighPriorityWorkersNum: 1, LowPriorityWorkersNum: 1}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithTemplatePriority("bulk", PriorityLow))
+
+	// The low priority lane is stuck, yet the other lanes are not delayed.
+	for i := 0; i < 3; i++ {
+		_, err := notifier.Notify(context.Background(), &Notification{Template: "bulk", Type: "test", TargetIdentifier: "token1"})
+		assert.NilError(t, err)
+	}
+	_, err := notifier.Notify(context.Background(), &Notification{Template: "interactive", Type: "test", TargetIdentifier: "token1", Priority: PriorityHigh})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-service.sentQueue).Template, "interactive")
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-service.sentQueue).Template, "t1")
+	// One bulk notification blocks the worker and the others wait for it.
+	assert.Assert(t, poll(func() bool {
+		return notifier.QueueLength()[PriorityLow] == 2
+	}))
+	assert.Equal(t, notifier.QueueLength()[PriorityHigh], 0)
+
+	close(service.block)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, (<-service.sentQueue).Template, "bulk")
+	}
+}
+
+func TestOrderByTarget(t *testing.T) {
+	service := &targetService{TestService: newTestService(), failures: map[string]error{}}
+	service.sentQueue = make(chan *Notification, 100)
+	slow := ServiceFunc(func(ctx context.Context, req *Notification) error {
+		if req.Data["seq"] == 0 {
+			time.Sleep(20 * time.Millisecond)
+		}
+		return service.Send(ctx, req)
+	})
+	var failed int32
+	config := &config.Config{WorkersNum: 4, OrderByTarget: true}
+	notifier := NewNotifier(config, map[string]Service{"test": slow},
+		WithRetryPolicy("test", RetryPolicy{MaxAttempts: 2, InitialBackoff: 10 * time.Millisecond}),
+		// The first notification of token2 fails once and is retried.
+		WithServiceMiddlewares("test", func(next Service) Service {
+			return ServiceFunc(func(ctx context.Context, req *Notification) error {
+				if req.TargetIdentifier == "token2" && req.Data["seq"] == 0 && atomic.CompareAndSwapInt32(&failed, 0, 1) {
+					return errors.New("unavailable")
+				}
+				return next.Send(ctx, req)
+			})
+		}))
+
+	for seq := 0; seq < 10; seq++ {
+		for _, token := range []string{"token1", "token2"} {
+			_, err := notifier.Notify(context.Background(), &Notification{
+				Template:         "t1",
+				Type:             "test",
+				TargetIdentifier: token,
+				Data:             map[string]interface{}{"seq": seq},
+			})
+			assert.NilError(t, err)
+		}
+	}
+
+	next := map[string]int{}
+	for i := 0; i < 20; i++ {
+		n := <-service.sentQueue
+		assert.Equal(t, n.Data["seq"], next[n.TargetIdentifier])
+		next[n.TargetIdentifier]++
+	}
+}
+
+type testScheduleStore struct {
+	sync.Mutex
+	scheduled map[string]*ScheduledNotification
+}
+
+func (s *testScheduleStore) SaveScheduled(scheduled *ScheduledNotification) error {
+	s.Lock()
+	defer s.Unlock()
+	s.scheduled[scheduled.ID] = scheduled
+	return nil
+}
+
+func (s *testScheduleStore) RemoveScheduled(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.scheduled, id)
+	return nil
+}
+
+func (s *testScheduleStore) Scheduled() ([]*ScheduledNotification, error) {
+	s.Lock()
+	defer s.Unlock()
+	var scheduled []*ScheduledNotification
+	for _, n := range s.scheduled {
+		scheduled = append(scheduled, n)
+	}
+	return scheduled, nil
+}
+
+func (s *testScheduleStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.scheduled)
+}
+
+func TestNotifyScheduled(t *testing.T) {
+	service := newTestService()
+	schedules := &testScheduleStore{scheduled: make(map[string]*ScheduledNotification)}
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithScheduleStore(schedules), WithDeliveryStore(deliveries))
+
+	later, err := notifier.NotifyAfter(context.Background(), &Notification{Template: "later", Type: "test", TargetIdentifier: "token1"}, time.Hour)
+	assert.NilError(t, err)
+	soon, err := notifier.NotifyAfter(context.Background(), &Notification{Template: "soon", Type: "test", TargetIdentifier: "token1"}, 50*time.Millisecond)
+	assert.NilError(t, err)
+	scheduled := notifier.Scheduled()
+	assert.Equal(t, len(scheduled), 2)
+	assert.Equal(t, scheduled[0].ID, soon)
+	d, _ := notifier.Delivery(later)
+	assert.Equal(t, d.State, DeliveryScheduled)
+
+	// The scheduled id is the delivery id once it is sent.
+	res := <-service.sentQueue
+	assert.Equal(t, res.Template, "soon")
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(soon)
+		return d.State == DeliverySent
+	}))
+	assert.Assert(t, poll(func() bool { return schedules.Len() == 1 }))
+
+	assert.NilError(t, notifier.CancelScheduled(later))
+	assert.ErrorIs(t, notifier.CancelScheduled(later), ErrScheduledNotFound)
+	d, _ = notifier.Delivery(later)
+	assert.Equal(t, d.State, DeliveryCanceled)
+	assert.Equal(t, schedules.Len(), 0)
+	assert.Equal(t, len(notifier.Scheduled()), 0)
+}
+
+func TestNotifyScheduledReload(t *testing.T) {
+	schedules := &testScheduleStore{scheduled: make(map[string]*ScheduledNotification)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": newTestService()}, WithScheduleStore(schedules))
+	_, err := notifier.NotifyAt(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"}, time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+	assert.Equal(t, schedules.Len(), 1)
+
+	// Notifications that became due while no Notifier was running are sent
+	// right away.
+	for _, s := range schedules.scheduled {
+		s.SendAt = time.Now().Add(-time.Minute)
+	}
+	service := newTestService()
+	NewNotifier(config, map[string]Service{"test": service}, WithScheduleStore(schedules))
+	res := <-service.sentQueue
+	assert.Equal(t, res.Template, "t1")
+	assert.Assert(t, poll(func() bool { return schedules.Len() == 0 }))
+}
+
+func TestNotifyScheduledFailed(t *testing.T) {
+	schedules := &testScheduleStore{scheduled: make(map[string]*ScheduledNotification)}
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	blocklist := &testBlocklist{blocked: make(map[string]string)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": newTestService()},
+		WithScheduleStore(schedules), WithDeliveryStore(deliveries), WithTokenBlocklist(blocklist))
+	id, err := notifier.NotifyAfter(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"}, 50*time.Millisecond)
+	assert.NilError(t, err)
+	assert.NilError(t, blocklist.BlockToken("test", "token1", "not registered"))
+
+	// A notification that can't be sent is not left for the next Notifier.
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(id)
+		return d.State == DeliveryFailed
+	}))
+	assert.Equal(t, schedules.Len(), 0)
+}
+
+func TestFallback(t *testing.T) {
+	primary := &flakyService{TestService: newTestService(), failures: 1, err: errors.New("unavailable")}
+	fallback := newTestService()
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"primary": primary, "fallback": fallback},
+		WithFallback("primary", "missing", "fallback"),
+		WithDeliveryStore(deliveries))
+
+	id, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "primary", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-fallback.sentQueue).TargetIdentifier, "token1")
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(id)
+		return d.State == DeliverySent
+	}))
+	d, _ := notifier.Delivery(id)
+	assert.Equal(t, d.Service, "fallback")
+	assert.Equal(t, d.Attempts, 1)
+
+	// Permanent errors don't fall back.
+	primary.Lock()
+	primary.failures, primary.err = 1, Permanent(errors.New("invalid notification"))
+	primary.Unlock()
+	id, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "primary", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(id)
+		return d.State == DeliveryFailed
+	}))
+	assert.Equal(t, len(fallback.sentQueue), 0)
+}
+
+func TestFallbackMulticast(t *testing.T) {
+	primary := &targetService{TestService: newTestService(), failures: map[string]error{
+		"token2": errors.New("unavailable"),
+		"token3": Permanent(errors.New("invalid token")),
+	}}
+	fallback := newTestService()
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"primary": primary, "fallback": fallback},
+		WithFallback("primary", "fallback"),
+		WithDeliveryStore(deliveries))
+
+	id, err := notifier.Notify(context.Background(), &Notification{
+		Template:          "t1",
+		Type:              "primary",
+		TargetIdentifiers: []string{"token1", "token2", "token3"},
+	})
+	assert.NilError(t, err)
+	var delivery *Delivery
+	assert.Assert(t, poll(func() bool {
+		delivery, _ = notifier.Delivery(id)
+		return delivery.State == DeliveryFailed
+	}))
+	assert.DeepEqual(t, delivery.Targets, []*TargetResult{
+		{TargetIdentifier: "token1", State: DeliverySent, Service: "primary"},
+		{TargetIdentifier: "token2", State: DeliverySent, Service: "fallback"},
+		{TargetIdentifier: "token3", State: DeliveryFailed, Error: "invalid token"},
+	})
+	assert.Equal(t, (<-fallback.sentQueue).TargetIdentifier, "token2")
+}
+
+type testBlocklist struct {
+	sync.Mutex
+	blocked map[string]string
+}
+
+func (b *testBlocklist) BlockToken(tokenType string, token string, reason string) error {
+	b.Lock()
+	defer b.Unlock()
+	b.blocked[tokenType+"/"+token] = reason
+	return nil
+}
+
+func (b *testBlocklist) IsTokenBlocked(tokenType string, token string) (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	_, ok := b.blocked[tokenType+"/"+token]
+	return ok, nil
+}
+
+func (b *testBlocklist) UnblockToken(tokenType string, token string) error {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.blocked, tokenType+"/"+token)
+	return nil
+}
+
+func TestInvalidTokens(t *testing.T) {
+	service := &targetService{TestService: newTestService(), failures: map[string]error{
+		"token2": Permanent(fmt.Errorf("%w: not registered", ErrInvalidToken)),
+	}}
+	blocklist := &testBlocklist{blocked: make(map[string]string)}
+	invalidated := make(chan *InvalidToken, 10)
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithTokenBlocklist(blocklist),
+		WithTokenInvalidatedHandler(func(ctx context.Context, token *InvalidToken) {
+			invalidated <- token
+		}))
+
+	_, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token2"})
+	assert.NilError(t, err)
+	invalid := <-invalidated
+	assert.Equal(t, invalid.TargetIdentifier, "token2")
+	assert.Equal(t, invalid.Template, "t1")
+	assert.Assert(t, notifier.IsTokenBlocked("test", "token2"))
+
+	// Blocked tokens are rejected, and skipped by multicast notifications.
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token2"})
+	assert.ErrorIs(t, err, ErrTokenBlocked)
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifiers: []string{"token1", "token2"}})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "token1")
+	assert.Equal(t, len(invalidated), 0)
+
+	assert.NilError(t, notifier.UnblockToken("test", "token2"))
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token2"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "token2")
+}
+
+func TestInvalidTokenOfType(t *testing.T) {
+	mqtt := &targetService{TestService: newTestService(), failures: map[string]error{
+		"lsp1": Permanent(fmt.Errorf("%w: invalid topic", ErrInvalidToken)),
+	}}
+	webhook := newTestService()
+	blocklist := &testBlocklist{blocked: make(map[string]string)}
+	invalidated := make(chan *InvalidToken, 10)
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"mqtt": mqtt, "webhook": webhook},
+		WithTokenBlocklist(blocklist),
+		WithTokenInvalidatedHandler(func(ctx context.Context, token *InvalidToken) {
+			invalidated <- token
+		}))
+
+	_, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "mqtt", TargetIdentifier: "lsp1"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-invalidated).Type, "mqtt")
+	assert.Assert(t, notifier.IsTokenBlocked("mqtt", "lsp1"))
+
+	// The same identifier of another type is not blocked.
+	assert.Assert(t, !notifier.IsTokenBlocked("webhook", "lsp1"))
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "webhook", TargetIdentifier: "lsp1"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-webhook.sentQueue).TargetIdentifier, "lsp1")
+	_, err = notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "mqtt", TargetIdentifier: "lsp1"})
+	assert.ErrorIs(t, err, ErrTokenBlocked)
+}
+
+func TestFallbackInvalidToken(t *testing.T) {
+	primary := &flakyService{TestService: newTestService(), failures: 1, err: errors.New("unavailable")}
+	fallback := &targetService{TestService: newTestService(), failures: map[string]error{
+		"token1": Permanent(fmt.Errorf("%w: not a url", ErrInvalidToken)),
+	}}
+	blocklist := &testBlocklist{blocked: make(map[string]string)}
+	deliveries := &testDeliveryStore{deliveries: make(map[string]*Delivery)}
+	invalidated := make(chan *InvalidToken, 10)
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"primary": primary, "fallback": fallback},
+		WithFallback("primary", "fallback"),
+		WithTokenBlocklist(blocklist),
+		WithDeliveryStore(deliveries),
+		WithTokenInvalidatedHandler(func(ctx context.Context, token *InvalidToken) {
+			invalidated <- token
+		}))
+
+	// The fallback rejecting the token of the primary doesn't block it.
+	id, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "primary", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	assert.Assert(t, poll(func() bool {
+		d, _ := notifier.Delivery(id)
+		return d.State == DeliveryFailed
+	}))
+	assert.Assert(t, !notifier.IsTokenBlocked("primary", "token1"))
+	assert.Equal(t, len(invalidated), 0)
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogging(t *testing.T) {
+	var buf syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&buf))
+	service := newTestService()
+	config := &config.Config{WorkersNum: 2}
+	notifier := NewNotifier(config, map[string]Service{"test": service},
+		WithLogger(logger), WithMiddlewares(Logging()))
+	id, err := notifier.Notify(WithRequestID(context.Background(), "req1"), &Notification{
+		Template:         "t1",
+		Type:             "test",
+		TargetIdentifier: "token1",
+		Data:             map[string]interface{}{"amount": 1000},
+	})
+	assert.NilError(t, err)
+	<-service.sentQueue
+
+	var record map[string]interface{}
+	assert.Assert(t, poll(func() bool {
+		line, _, _ := strings.Cut(buf.String(), "\n")
+		return json.Unmarshal([]byte(line), &record) == nil
+	}))
+	assert.Equal(t, record["msg"], "sent notification")
+	assert.Equal(t, record["request_id"], "req1")
+	assert.Equal(t, record["delivery_id"], id)
+	assert.Equal(t, record["service"], "test")
+	assert.DeepEqual(t, record["notification"], map[string]interface{}{
+		"template":          "t1",
+		"type":              "test",
+		"target_identifier": "token1",
+		"data":              map[string]interface{}{"amount": float64(1000)},
+	})
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	primary := &flakyService{TestService: newTestService(), failures: 10, err: errors.New("unavailable")}
+	fallback := newTestService()
+	config := &config.Config{WorkersNum: 1}
+	notifier := NewNotifier(config, map[string]Service{"primary": primary, "fallback": fallback},
+		WithFallback("primary", "fallback"),
+		WithCircuitBreaker("primary", BreakerPolicy{FailureThreshold: 2, OpenTimeout: 100 * time.Millisecond}))
+
+	for i := 0; i < 4; i++ {
+		_, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "primary", TargetIdentifier: "token1"})
+		assert.NilError(t, err)
+		<-fallback.sentQueue
+	}
+	// Once open, the circuit diverts the sends to the fallback without
+	// calling the primary service.
+	primary.Lock()
+	assert.Equal(t, primary.failures, 8)
+	primary.failures = 0
+	primary.Unlock()
+	circuits := notifier.Circuits()
+	assert.Equal(t, len(circuits), 1)
+	assert.Equal(t, circuits[0].State, CircuitOpen)
+	assert.Equal(t, circuits[0].Failures, 2)
+
+	// After the open timeout a probe goes through and closes the circuit.
+	time.Sleep(100 * time.Millisecond)
+	_, err := notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "primary", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	<-primary.sentQueue
+	assert.Assert(t, poll(func() bool { return notifier.Circuits()[0].State == CircuitClosed }))
+
+	assert.ErrorIs(t, notifier.ResetCircuit("fallback"), ErrCircuitNotFound)
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := &circuitBreaker{policy: BreakerPolicy{FailureThreshold: 1, OpenTimeout: time.Millisecond, HalfOpenRequests: 2}, state: CircuitClosed}
+	assert.NilError(t, b.allow())
+	state, changed := b.record(true)
+	assert.Equal(t, state, CircuitOpen)
+	assert.Assert(t, changed)
+	assert.ErrorIs(t, b.allow(), ErrCircuitOpen)
+
+	time.Sleep(time.Millisecond)
+	assert.NilError(t, b.allow())
+	assert.NilError(t, b.allow())
+	assert.ErrorIs(t, b.allow(), ErrCircuitOpen)
+	state, _ = b.record(false)
+	assert.Equal(t, state, CircuitHalfOpen)
+	state, _ = b.record(true)
+	assert.Equal(t, state, CircuitOpen)
+
+	b.reset()
+	assert.Equal(t, b.circuit("test").State, CircuitClosed)
+	assert.Assert(t, !serviceFailed(Permanent(errors.New("invalid"))))
+	assert.Assert(t, !serviceFailed(&MulticastError{Sent: []string{"a"}, Failed: []*TargetError{{TargetIdentifier: "b", Err: errors.New("unavailable")}}}))
+	assert.Assert(t, serviceFailed(&MulticastError{Failed: []*TargetError{{TargetIdentifier: "b", Err: errors.New("unavailable")}}}))
+}
@@ -0,0 +1,164 @@
+package notify
+
+import (
+	"context"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/breez/notify/config"
+	"github.com/golang-queue/queue"
+)
+
+// Priority selects the lane a notification is queued in. Every lane has its
+// own workers, so a burst in one lane doesn't delay the others.
+type Priority string
+
+const (
+	// PriorityHigh is for notifications someone is waiting on, like the ones
+	// that expect a reply from the device.
+	PriorityHigh   Priority = "high"
+	PriorityNormal Priority = "normal"
+	// PriorityLow is for bulk notifications that can wait.
+	PriorityLow Priority = "low"
+)
+
+// WithTemplatePriority sets the priority of the notifications of the given
+// template that don't set their own.
+func WithTemplatePriority(template string, priority Priority) Option {
+	return func(n *Notifier) {
+		n.templatePriorities[template] = priority
+	}
+}
+
+// lane runs the tasks of a priority.
+type lane interface {
+	// queueTask queues the task. Tasks with the same key may be required to
+	// run in order.
+	queueTask(key string, task queue.TaskFunc) error
+	// length is the number of tasks waiting for a worker.
+	length() int
+	release()
+	shutdown()
+}
+
+// waitingCounter counts the tasks of a lane that wait for a worker.
+type waitingCounter struct {
+	waiting int64
+}
+
+func (c *waitingCounter) count(q *queue.Queue, task queue.TaskFunc) error {
+	atomic.AddInt64(&c.waiting, 1)
+	err := q.QueueTask(func(ctx context.Context) error {
+		atomic.AddInt64(&c.waiting, -1)
+		return task(ctx)
+	})
+	if err != nil {
+		atomic.AddInt64(&c.waiting, -1)
+	}
+	return err
+}
+
+func (c *waitingCounter) length() int {
+	return int(atomic.LoadInt64(&c.waiting))
+}
+
+// poolLane runs the tasks concurrently on a pool of workers.
+type poolLane struct {
+	waitingCounter
+	queue *queue.Queue
+}
+
+func (l *poolLane) queueTask(key string, task queue.TaskFunc) error {
+	return l.count(l.queue, task)
+}
+
+func (l *poolLane) release() {
+	l.queue.Release()
+}
+
+func (l *poolLane) shutdown() {
+	l.queue.Shutdown()
+}
+
+// shardedLane runs the tasks on single worker shards selected by the task
+// key, so the tasks with the same key run one after the other in the order
+// they were queued, while tasks with other keys run in parallel.
+type shardedLane struct {
+	waitingCounter
+	shards []*queue.Queue
+}
+
+func newShardedLane(workers int) *shardedLane {
+	shards := make([]*queue.Queue, workers)
+	for i := range shards {
+		shards[i] = queue.NewPool(1)
+	}
+	return &shardedLane{shards: shards}
+}
+
+func (l *shardedLane) queueTask(key string, task queue.TaskFunc) error {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return l.count(l.shards[h.Sum32()%uint32(len(l.shards))], task)
+}
+
+func (l *shardedLane) release() {
+	for _, shard := range l.shards {
+		shard.Release()
+	}
+}
+
+func (l *shardedLane) shutdown() {
+	for _, shard := range l.shards {
+		shard.Shutdown()
+	}
+}
+
+// newLanes creates a lane for the normal priority and for every other
+// priority that has workers configured. Priorities without workers share the
+// normal lane.
+func newLanes(config *config.Config) map[Priority]lane {
+	newLane := func(workers int) lane {
+		if config.OrderByTarget {
+			return newShardedLane(workers)
+		}
+		return &poolLane{queue: queue.NewPool(workers)}
+	}
+	lanes := map[Priority]lane{
+		PriorityNormal: newLane(config.WorkersNum),
+	}
+	if config.HighPriorityWorkersNum > 0 {
+		lanes[PriorityHigh] = newLane(config.HighPriorityWorkersNum)
+	}
+	if config.LowPriorityWorkersNum > 0 {
+		lanes[PriorityLow] = newLane(config.LowPriorityWorkersNum)
+	}
+	return lanes
+}
+
+func (n *Notifier) priority(notification *Notification) Priority {
+	if notification.Priority != "" {
+		return notification.Priority
+	}
+	if priority, ok := n.templatePriorities[notification.Template]; ok {
+		return priority
+	}
+	return PriorityNormal
+}
+
+func (n *Notifier) lane(notification *Notification) lane {
+	if lane, ok := n.lanes[n.priority(notification)]; ok {
+		return lane
+	}
+	return n.lanes[PriorityNormal]
+}
+
+// QueueLength returns the number of notifications waiting for a worker in
+// every priority lane.
+func (n *Notifier) QueueLength() map[Priority]int {
+	lengths := make(map[Priority]int, len(n.lanes))
+	for priority, lane := range n.lanes {
+		lengths[priority] = lane.length()
+	}
+	return lengths
+}
@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how many times and how often a failed notification is
+// sent again before it is given up and moved to the dead letter store.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of send attempts, including the first.
+	MaxAttempts int
+	// InitialBackoff is the delay before the second attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the delay after every attempt. Defaults to 2.
+	Multiplier float64
+	// Jitter randomizes every delay by up to the given fraction of it.
+	Jitter float64
+	// Retryable classifies errors. Defaults to IsRetryable.
+	Retryable func(error) bool
+}
+
+// NoRetry sends every notification exactly once.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+func (p RetryPolicy) shouldRetry(attempts int, err error) bool {
+	if attempts >= p.MaxAttempts {
+		return false
+	}
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	return retryable(err)
+}
+
+func (p RetryPolicy) backoff(attempts int) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(multiplier, float64(attempts-1))
+	if p.MaxBackoff > 0 && backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		backoff += backoff * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(backoff)
+}
+
+func (n *Notifier) retryPolicy(serviceType string) RetryPolicy {
+	if policy, ok := n.retryPolicies[serviceType]; ok {
+		return policy
+	}
+	return n.defaultRetryPolicy
+}
+
+// PermanentError marks an error that will not go away by sending the same
+// notification again, for example an invalid token or an unknown template.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent wraps err so that it is not retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PermanentError{Err: err}
+}
+
+// IsPermanent reports whether err or any error it wraps is permanent.
+func IsPermanent(err error) bool {
+	var permanent *PermanentError
+	return errors.As(err, &permanent)
+}
+
+// IsRetryable is the default error classification: everything that is not
+// permanent is retried.
+func IsRetryable(err error) bool {
+	return !IsPermanent(err)
+}
@@ -0,0 +1,169 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrScheduledNotFound = errors.New("scheduled notification not found")
+)
+
+// ScheduledNotification is a notification that is notified at SendAt.
+type ScheduledNotification struct {
+	// ID is also the delivery id of the notification.
+	ID           string        `json:"id"`
+	Notification *Notification `json:"notification"`
+	SendAt       time.Time     `json:"send_at"`
+}
+
+// ScheduleStore persists the scheduled notifications, so they are still
+// sent after a restart.
+type ScheduleStore interface {
+	SaveScheduled(scheduled *ScheduledNotification) error
+	RemoveScheduled(id string) error
+	// Scheduled returns all the scheduled notifications.
+	Scheduled() ([]*ScheduledNotification, error)
+}
+
+// WithScheduleStore persists the scheduled notifications. Without it they
+// are kept in memory only.
+func WithScheduleStore(store ScheduleStore) Option {
+	return func(n *Notifier) {
+		n.scheduleStore = store
+	}
+}
+
+type scheduledTimer struct {
+	scheduled *ScheduledNotification
+	ctx       context.Context
+	timer     *time.Timer
+}
+
+// NotifyAt schedules the notification to be notified at the given time and
+// returns its id, which is also its delivery id once it is sent.
+func (n *Notifier) NotifyAt(c context.Context, request *Notification, at time.Time) (string, error) {
+	if n.isClosing() {
+		return "", ErrShuttingDown
+	}
+	scheduled := &ScheduledNotification{
+		ID:           newID(),
+		Notification: request,
+		SendAt:       at.UTC(),
+	}
+	if n.scheduleStore != nil {
+		if err := n.scheduleStore.SaveScheduled(scheduled); err != nil {
+			return "", fmt.Errorf("failed to persist scheduled notification: %w", err)
+		}
+	}
+	n.schedule(detach(c), scheduled)
+	return scheduled.ID, nil
+}
+
+// NotifyAfter schedules the notification to be notified after the given
+// delay. See NotifyAt.
+func (n *Notifier) NotifyAfter(c context.Context, request *Notification, delay time.Duration) (string, error) {
+	return n.NotifyAt(c, request, time.Now().Add(delay))
+}
+
+// CancelScheduled cancels a scheduled notification that was not sent yet.
+func (n *Notifier) CancelScheduled(id string) error {
+	n.scheduleMu.Lock()
+	s, ok := n.scheduled[id]
+	if ok {
+		s.timer.Stop()
+		delete(n.scheduled, id)
+	}
+	n.scheduleMu.Unlock()
+	if !ok {
+		return ErrScheduledNotFound
+	}
+	n.setState(&task{id: id, notification: s.scheduled.Notification}, DeliveryCanceled, nil)
+	return n.removeScheduled(id)
+}
+
+// Scheduled lists the notifications that are scheduled and not sent yet,
+// ordered by the time they are sent at.
+func (n *Notifier) Scheduled() []*ScheduledNotification {
+	n.scheduleMu.Lock()
+	defer n.scheduleMu.Unlock()
+	scheduled := make([]*ScheduledNotification, 0, len(n.scheduled))
+	for _, s := range n.scheduled {
+		scheduled = append(scheduled, s.scheduled)
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduled[i].SendAt.Before(scheduled[j].SendAt)
+	})
+	return scheduled
+}
+
+func (n *Notifier) schedule(ctx context.Context, scheduled *ScheduledNotification) {
+	n.setState(&task{id: scheduled.ID, notification: scheduled.Notification}, DeliveryScheduled, nil)
+	n.scheduleMu.Lock()
+	defer n.scheduleMu.Unlock()
+	n.scheduled[scheduled.ID] = &scheduledTimer{
+		scheduled: scheduled,
+		ctx:       ctx,
+		timer: time.AfterFunc(time.Until(scheduled.SendAt), func() {
+			n.fireScheduled(scheduled.ID)
+		}),
+	}
+}
+
+func (n *Notifier) fireScheduled(id string) {
+	n.scheduleMu.Lock()
+	s, ok := n.scheduled[id]
+	delete(n.scheduled, id)
+	n.scheduleMu.Unlock()
+	if !ok {
+		return
+	}
+	if _, err := n.notify(s.ctx, id, s.scheduled.Notification); err != nil {
+		n.log(s.ctx).Error("failed to notify scheduled notification", "delivery_id", id, "error", err)
+		if errors.Is(err, ErrShuttingDown) {
+			// Left in the store, to be sent by the next Notifier.
+			return
+		}
+		n.setState(&task{id: id, notification: s.scheduled.Notification}, DeliveryFailed, err)
+	}
+	if err := n.removeScheduled(id); err != nil {
+		n.log(s.ctx).Error("failed to remove scheduled notification", "delivery_id", id, "error", err)
+	}
+}
+
+func (n *Notifier) removeScheduled(id string) error {
+	if n.scheduleStore == nil {
+		return nil
+	}
+	return n.scheduleStore.RemoveScheduled(id)
+}
+
+// loadScheduled schedules the notifications persisted by a previous run.
+// The ones that are due are sent right away.
+func (n *Notifier) loadScheduled() {
+	if n.scheduleStore == nil {
+		return
+	}
+	scheduled, err := n.scheduleStore.Scheduled()
+	if err != nil {
+		n.logger.Error("failed to load scheduled notifications", "error", err)
+		return
+	}
+	for _, s := range scheduled {
+		n.schedule(context.Background(), s)
+	}
+}
+
+// stopScheduled stops the timers of the scheduled notifications. The
+// persisted ones are scheduled again by the next Notifier.
+func (n *Notifier) stopScheduled() {
+	n.scheduleMu.Lock()
+	defer n.scheduleMu.Unlock()
+	for id, s := range n.scheduled {
+		s.timer.Stop()
+		delete(n.scheduled, id)
+	}
+}
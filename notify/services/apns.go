@@ -0,0 +1,294 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+)
+
+const (
+	APNSProduction  = "https://api.push.apple.com"
+	APNSDevelopment = "https://api.sandbox.push.apple.com"
+
+	// apnsTokenLifetime is how long a provider token is reused. APNs
+	// rejects tokens older than an hour and refreshing them more often than
+	// every 20 minutes.
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// ErrBadDeviceToken is returned for the device tokens that are not hex, which
+// are rejected before they are put in the request path.
+var ErrBadDeviceToken = notify.Permanent(fmt.Errorf("%w: invalid apns device token", notify.ErrInvalidToken))
+
+// The APNs push types.
+const (
+	APNSPushTypeAlert      = "alert"
+	APNSPushTypeBackground = "background"
+	APNSPushTypeVoIP       = "voip"
+)
+
+// The APNs priorities.
+const (
+	APNSPriorityLow    = 1
+	APNSPriorityNormal = 5
+	APNSPriorityHigh   = 10
+)
+
+// The reasons APNs reports for the rejected notifications.
+const (
+	APNSBadCollapseID               = "BadCollapseId"
+	APNSBadDeviceToken              = "BadDeviceToken"
+	APNSBadExpirationDate           = "BadExpirationDate"
+	APNSBadMessageID                = "BadMessageId"
+	APNSBadPriority                 = "BadPriority"
+	APNSBadTopic                    = "BadTopic"
+	APNSDeviceTokenNotForTopic      = "DeviceTokenNotForTopic"
+	APNSDuplicateHeaders            = "DuplicateHeaders"
+	APNSIdleTimeout                 = "IdleTimeout"
+	APNSInvalidPushType             = "InvalidPushType"
+	APNSMissingDeviceToken          = "MissingDeviceToken"
+	APNSMissingTopic                = "MissingTopic"
+	APNSPayloadEmpty                = "PayloadEmpty"
+	APNSTopicDisallowed             = "TopicDisallowed"
+	APNSBadCertificate              = "BadCertificate"
+	APNSBadCertificateEnvironment   = "BadCertificateEnvironment"
+	APNSExpiredProviderToken        = "ExpiredProviderToken"
+	APNSForbidden                   = "Forbidden"
+	APNSInvalidProviderToken        = "InvalidProviderToken"
+	APNSMissingProviderToken        = "MissingProviderToken"
+	APNSBadPath                     = "BadPath"
+	APNSMethodNotAllowed            = "MethodNotAllowed"
+	APNSUnregistered                = "Unregistered"
+	APNSPayloadTooLarge             = "PayloadTooLarge"
+	APNSTooManyProviderTokenUpdates = "TooManyProviderTokenUpdates"
+	APNSTooManyRequests             = "TooManyRequests"
+	APNSInternalServerError         = "InternalServerError"
+	APNSServiceUnavailable          = "ServiceUnavailable"
+	APNSShutdown                    = "Shutdown"
+)
+
+// APNSError is an error returned by APNs for a notification.
+// BadDeviceToken, DeviceTokenNotForTopic and Unregistered match
+// notify.ErrInvalidToken. Throttling (429), the server errors and the
+// expired provider tokens and idle timeouts are retried, all the other
+// reasons are permanent.
+type APNSError struct {
+	StatusCode int
+	Reason     string
+	// Timestamp is when APNs learned the device token is no longer valid,
+	// for the Unregistered reason.
+	Timestamp time.Time
+}
+
+func (e *APNSError) Error() string {
+	return fmt.Sprintf("failed to send apns notification %v %v", e.StatusCode, e.Reason)
+}
+
+func (e *APNSError) Is(target error) bool {
+	if target != notify.ErrInvalidToken {
+		return false
+	}
+	switch e.Reason {
+	case APNSBadDeviceToken, APNSDeviceTokenNotForTopic, APNSUnregistered:
+		return true
+	}
+	return false
+}
+
+func (e *APNSError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests ||
+		e.StatusCode >= http.StatusInternalServerError ||
+		e.Reason == APNSExpiredProviderToken ||
+		e.Reason == APNSIdleTimeout
+}
+
+// APNSMessage is a notification to a single device.
+type APNSMessage struct {
+	DeviceToken string
+	// Topic defaults to the topic of the service, the bundle id of the app.
+	Topic string
+	// PushType is one of the APNSPushType values.
+	PushType string
+	// Priority is one of the APNSPriority values, left to APNs when zero.
+	Priority int
+	// Expiration is when APNs stops trying to deliver the notification.
+	// When zero APNs doesn't store it.
+	Expiration time.Time
+	// CollapseID merges the notifications with the same id on the device.
+	CollapseID string
+	// Payload is marshalled to JSON, with the aps dictionary.
+	Payload interface{}
+}
+
+type APNSMessageBuilder func(req *notify.Notification) (*APNSMessage, error)
+
+// APNSConfig holds the token-based authentication and the endpoint of the
+// APNs service.
+type APNSConfig struct {
+	KeyID  string
+	TeamID string
+	// Key is the private key of the .p8 file, see ParseAPNSKey.
+	Key   *ecdsa.PrivateKey
+	Topic string
+	// Endpoint defaults to APNSProduction.
+	Endpoint string
+	// Client defaults to an http.Client speaking HTTP/2.
+	Client *http.Client
+}
+
+// APNS sends the notifications to the Apple Push Notification service.
+type APNS struct {
+	messageBuilder APNSMessageBuilder
+	config         APNSConfig
+
+	mu       sync.Mutex
+	token    string
+	issuedAt time.Time
+}
+
+func NewAPNS(messageBuilder APNSMessageBuilder, config APNSConfig) *APNS {
+	if config.Endpoint == "" {
+		config.Endpoint = APNSProduction
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: true}}
+	}
+	return &APNS{messageBuilder: messageBuilder, config: config}
+}
+
+// ParseAPNSKey parses the PEM encoded .p8 key downloaded from the Apple
+// developer account.
+func ParseAPNSKey(p8 []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(p8)
+	if block == nil {
+		return nil, errors.New("invalid apns key: no PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apns key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("invalid apns key: not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+func (a *APNS) Send(ctx context.Context, req *notify.Notification) error {
+	message, err := a.messageBuilder(req)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if message == nil {
+		return ErrUnrecognizedTemplate
+	}
+	if message.DeviceToken == "" {
+		message.DeviceToken = req.TargetIdentifier
+	}
+	if _, err := hex.DecodeString(message.DeviceToken); err != nil || message.DeviceToken == "" {
+		return ErrBadDeviceToken
+	}
+	payload, err := json.Marshal(message.Payload)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to marshal apns payload %v", err))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		a.config.Endpoint+"/3/device/"+message.DeviceToken, bytes.NewReader(payload))
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create apns request %v", err))
+	}
+	token, err := a.providerToken()
+	if err != nil {
+		return notify.Permanent(err)
+	}
+	request.Header.Set("authorization", "bearer "+token)
+	request.Header.Set("content-type", "application/json")
+	topic := message.Topic
+	if topic == "" {
+		topic = a.config.Topic
+	}
+	request.Header.Set("apns-topic", topic)
+	if message.PushType != "" {
+		request.Header.Set("apns-push-type", message.PushType)
+	}
+	if message.Priority != 0 {
+		request.Header.Set("apns-priority", strconv.Itoa(message.Priority))
+	}
+	if !message.Expiration.IsZero() {
+		request.Header.Set("apns-expiration", strconv.FormatInt(message.Expiration.Unix(), 10))
+	}
+	if message.CollapseID != "" {
+		request.Header.Set("apns-collapse-id", message.CollapseID)
+	}
+
+	res, err := a.config.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send apns notification %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		notify.Logger(ctx).Debug("sent apns notification", "apns_id", res.Header.Get("apns-id"))
+		return nil
+	}
+	return a.newAPNSError(res)
+}
+
+func (a *APNS) newAPNSError(res *http.Response) error {
+	var body struct {
+		Reason    string `json:"reason"`
+		Timestamp int64  `json:"timestamp"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	json.Unmarshal(data, &body)
+	apnsErr := &APNSError{StatusCode: res.StatusCode, Reason: body.Reason}
+	if body.Timestamp > 0 {
+		apnsErr.Timestamp = time.UnixMilli(body.Timestamp)
+	}
+	if apnsErr.Reason == APNSExpiredProviderToken {
+		a.mu.Lock()
+		a.token = ""
+		a.mu.Unlock()
+	}
+	if apnsErr.retryable() {
+		return apnsErr
+	}
+	return notify.Permanent(apnsErr)
+}
+
+// providerToken returns the ES256 JWT authenticating the requests, reused
+// for apnsTokenLifetime.
+func (a *APNS) providerToken() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Since(a.issuedAt) < apnsTokenLifetime {
+		return a.token, nil
+	}
+	if a.config.Key == nil {
+		return "", errors.New("apns key is not configured")
+	}
+
+	now := time.Now()
+	token, err := signES256(a.config.Key,
+		map[string]string{"alg": "ES256", "kid": a.config.KeyID},
+		map[string]interface{}{"iss": a.config.TeamID, "iat": now.Unix()})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign apns provider token %w", err)
+	}
+	a.token = token
+	a.issuedAt = now
+	return a.token, nil
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+// verifyES256 checks the signature of a provider token.
+func verifyES256(token string, key *ecdsa.PublicKey) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || len(signature) != 64 {
+		return false
+	}
+	digest := sha256.Sum256([]byte(token[:i]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	return ecdsa.Verify(key, digest[:], r, s)
+}
+
+func testAPNSKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NilError(t, err)
+	parsed, err := ParseAPNSKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	assert.NilError(t, err)
+	return parsed
+}
+
+func TestAPNS(t *testing.T) {
+	key := testAPNSKey(t)
+	type received struct {
+		header  http.Header
+		payload map[string]interface{}
+	}
+	requests := make(chan received, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			w.WriteHeader(http.StatusHTTPVersionNotSupported)
+			return
+		}
+		auth := strings.TrimPrefix(r.Header.Get("authorization"), "bearer ")
+		if !verifyES256(auth, &key.PublicKey) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason":"InvalidProviderToken"}`))
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/3/device/") {
+		case "626164":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason":"BadDeviceToken"}`))
+		case "676f6e65":
+			w.WriteHeader(http.StatusGone)
+			w.Write([]byte(`{"reason":"Unregistered","timestamp":1700000000000}`))
+		case "62757379":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"reason":"TooManyRequests"}`))
+		default:
+			body, _ := io.ReadAll(r.Body)
+			var payload map[string]interface{}
+			json.Unmarshal(body, &payload)
+			requests <- received{header: r.Header, payload: payload}
+			w.Header().Set("apns-id", "id1")
+		}
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	expiration := time.Unix(1800000000, 0)
+	apns := NewAPNS(testBuilder(func(req *notify.Notification) *APNSMessage {
+		return &APNSMessage{
+			PushType:   APNSPushTypeAlert,
+			Priority:   APNSPriorityHigh,
+			Expiration: expiration,
+			CollapseID: "c1",
+			Payload:    map[string]interface{}{"aps": map[string]interface{}{"alert": "hello"}},
+		}
+	}), APNSConfig{
+		KeyID:    "key1",
+		TeamID:   "team1",
+		Key:      key,
+		Topic:    "com.breez.app",
+		Endpoint: server.URL,
+		Client:   server.Client(),
+	})
+
+	err := apns.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "746f6b656e31"})
+	assert.NilError(t, err)
+	r := <-requests
+	assert.Equal(t, r.header.Get("apns-topic"), "com.breez.app")
+	assert.Equal(t, r.header.Get("apns-push-type"), "alert")
+	assert.Equal(t, r.header.Get("apns-priority"), "10")
+	assert.Equal(t, r.header.Get("apns-expiration"), "1800000000")
+	assert.Equal(t, r.header.Get("apns-collapse-id"), "c1")
+	assert.DeepEqual(t, r.payload, map[string]interface{}{"aps": map[string]interface{}{"alert": "hello"}})
+
+	// The provider token is reused.
+	token := strings.TrimPrefix(r.header.Get("authorization"), "bearer ")
+	assert.NilError(t, apns.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "746f6b656e32"}))
+	r = <-requests
+	assert.Equal(t, r.header.Get("authorization"), "bearer "+token)
+
+	err = apns.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "626164"})
+	var apnsErr *APNSError
+	assert.Assert(t, errors.As(err, &apnsErr))
+	assert.Equal(t, apnsErr.Reason, APNSBadDeviceToken)
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = apns.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "676f6e65"})
+	assert.Assert(t, errors.As(err, &apnsErr))
+	assert.Equal(t, apnsErr.StatusCode, http.StatusGone)
+	assert.Equal(t, apnsErr.Timestamp, time.UnixMilli(1700000000000))
+	assert.Assert(t, notify.IsInvalidToken(err))
+
+	err = apns.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "62757379"})
+	assert.Assert(t, errors.As(err, &apnsErr))
+	assert.Equal(t, apnsErr.Reason, APNSTooManyRequests)
+	assert.Assert(t, notify.IsRetryable(err))
+	assert.Assert(t, !notify.IsInvalidToken(err))
+
+	// The malformed tokens never reach APNs.
+	for _, token := range []string{"", "token1", "../../x?y=z"} {
+		err = apns.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: token})
+		assert.ErrorIs(t, err, ErrBadDeviceToken)
+		assert.Assert(t, notify.IsInvalidToken(err))
+		assert.Assert(t, notify.IsPermanent(err))
+	}
+
+	assertUnrecognizedTemplate(t, apns, "746f6b656e31")
+}
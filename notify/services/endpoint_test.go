@@ -0,0 +1,37 @@
+package services
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+func TestPublicClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	_, err := newPublicClient(time.Second).Get(server.URL)
+	assert.Assert(t, errors.Is(err, ErrPrivateAddress), err)
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+}
+
+func TestAllowedHost(t *testing.T) {
+	hosts := []string{"push.example.com", "*.push.apple.com"}
+	for host, allowed := range map[string]bool{
+		"push.example.com":      true,
+		"PUSH.example.com":      true,
+		"web.push.apple.com":    true,
+		"push.apple.com":        false,
+		"evilpush.apple.com":    false,
+		"push.example.com.evil": false,
+		"other.example.com":     false,
+	} {
+		assert.Equal(t, allowedHost(host, hosts), allowed, host)
+	}
+}
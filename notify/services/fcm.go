@@ -4,37 +4,178 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 
 	"firebase.google.com/go/messaging"
 	"github.com/breez/notify/notify"
 )
 
+// fcmConcurrency bounds the messages of a multicast sent at the same time.
+// FCM has no batch endpoint anymore, every message is its own request.
+const fcmConcurrency = 10
+
 var (
-	ErrUnrecognizedTemplate = errors.New("unrecognized template")
+	ErrUnrecognizedTemplate = notify.Permanent(errors.New("unrecognized template"))
+)
+
+// The FCM error codes, as reported by the messaging package.
+const (
+	FCMInternalError                  = "internal-error"
+	FCMInvalidAPNSCredentials         = "invalid-apns-credentials"
+	FCMInvalidArgument                = "invalid-argument"
+	FCMMessageRateExceeded            = "message-rate-exceeded"
+	FCMMismatchedCredential           = "mismatched-credential"
+	FCMRegistrationTokenNotRegistered = "registration-token-not-registered"
+	FCMServerUnavailable              = "server-unavailable"
+	FCMUnknownError                   = "unknown-error"
 )
 
+var fcmErrorCodes = []struct {
+	code      string
+	is        func(error) bool
+	permanent bool
+}{
+	{FCMRegistrationTokenNotRegistered, messaging.IsRegistrationTokenNotRegistered, true},
+	{FCMInvalidArgument, messaging.IsInvalidArgument, true},
+	{FCMMismatchedCredential, messaging.IsMismatchedCredential, true},
+	{FCMInvalidAPNSCredentials, messaging.IsInvalidAPNSCredentials, true},
+	{FCMMessageRateExceeded, messaging.IsMessageRateExceeded, false},
+	{FCMServerUnavailable, messaging.IsServerUnavailable, false},
+	{FCMInternalError, messaging.IsInternal, false},
+}
+
+// FCMError is an error returned by FCM for a message. Unregistered tokens
+// match notify.ErrInvalidToken, and the errors that will not go away by
+// sending again are wrapped with notify.Permanent.
+type FCMError struct {
+	// Code is one of the FCM error codes, FCMUnknownError when FCM did not
+	// report one.
+	Code string
+	Err  error
+}
+
+func (e *FCMError) Error() string {
+	return fmt.Sprintf("failed to send fcm message %v", e.Err)
+}
+
+func (e *FCMError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FCMError) Is(target error) bool {
+	return target == notify.ErrInvalidToken && e.Code == FCMRegistrationTokenNotRegistered
+}
+
+func newFCMError(err error) error {
+	for _, c := range fcmErrorCodes {
+		if c.is(err) {
+			fcmErr := &FCMError{Code: c.code, Err: err}
+			if c.permanent {
+				return notify.Permanent(fcmErr)
+			}
+			return fcmErr
+		}
+	}
+	return &FCMError{Code: FCMUnknownError, Err: err}
+}
+
+// FCMClient is the part of messaging.Client used by the FCM service.
+type FCMClient interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+}
+
 type FCMMessageBuilder func(req *notify.Notification) (*messaging.Message, error)
 type FCM struct {
 	messageBuilder FCMMessageBuilder
-	client         *messaging.Client
+	client         FCMClient
 }
 
-func NewFCM(messageBuilder FCMMessageBuilder, client *messaging.Client) *FCM {
+func NewFCM(messageBuilder FCMMessageBuilder, client FCMClient) *FCM {
 	return &FCM{messageBuilder: messageBuilder, client: client}
 }
 
+func (f *FCM) SupportsMulticast() bool {
+	return true
+}
+
 func (f *FCM) Send(context context.Context, req *notify.Notification) error {
-	pushNotification, err := f.messageBuilder(req)
-	if err != nil {
-		return fmt.Errorf("failed to create message %v", err)
+	if len(req.TargetIdentifiers) > 0 {
+		return f.sendMulticast(context, req)
 	}
-	if pushNotification == nil {
-		return ErrUnrecognizedTemplate
+	pushNotification, err := f.buildMessage(req)
+	if err != nil {
+		return err
 	}
-	_, err = f.client.Send(context, pushNotification)
+	messageID, err := f.client.Send(context, pushNotification)
 	if err != nil {
-		return fmt.Errorf("failed to send fcm message %v", err)
+		return newFCMError(err)
+	}
+	notify.Logger(context).Debug("sent fcm message", "message_id", messageID)
+
+	return nil
+}
+
+// sendMulticast builds a message per target and sends them
+// fcmConcurrency at a time, reporting the failed targets in a
+// notify.MulticastError.
+func (f *FCM) sendMulticast(ctx context.Context, req *notify.Notification) error {
+	var messages []*messaging.Message
+	for _, target := range req.TargetIdentifiers {
+		single := *req
+		single.TargetIdentifier = target
+		single.TargetIdentifiers = nil
+		message, err := f.buildMessage(&single)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, message)
+	}
+
+	errs := make([]error, len(messages))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < fcmConcurrency && w < len(messages); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if _, err := f.client.Send(ctx, messages[i]); err != nil {
+					errs[i] = newFCMError(err)
+				}
+			}
+		}()
 	}
+	for i := range messages {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
 
+	result := &notify.MulticastError{}
+	for i, err := range errs {
+		if err == nil {
+			result.Sent = append(result.Sent, req.TargetIdentifiers[i])
+			continue
+		}
+		result.Failed = append(result.Failed, &notify.TargetError{
+			TargetIdentifier: req.TargetIdentifiers[i],
+			Err:              err,
+		})
+	}
+	notify.Logger(ctx).Debug("sent fcm multicast", "success", len(result.Sent), "failure", len(result.Failed))
+	if len(result.Failed) > 0 {
+		return result
+	}
 	return nil
 }
+
+func (f *FCM) buildMessage(req *notify.Notification) (*messaging.Message, error) {
+	pushNotification, err := f.messageBuilder(req)
+	if err != nil {
+		return nil, notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if pushNotification == nil {
+		return nil, ErrUnrecognizedTemplate
+	}
+	return pushNotification, nil
+}
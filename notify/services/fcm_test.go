@@ -0,0 +1,128 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"github.com/breez/notify/notify"
+	"google.golang.org/api/option"
+	"gotest.tools/v3/assert"
+)
+
+type testFCMClient struct {
+	invalid map[string]bool
+
+	mu         sync.Mutex
+	sent       int
+	running    int
+	maxRunning int
+}
+
+func (c *testFCMClient) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	c.mu.Lock()
+	c.sent++
+	c.running++
+	if c.running > c.maxRunning {
+		c.maxRunning = c.running
+	}
+	c.mu.Unlock()
+	time.Sleep(time.Millisecond)
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+	if c.invalid[message.Token] {
+		return "", errors.New("not registered")
+	}
+	return "id", nil
+}
+
+func testMessageBuilder(req *notify.Notification) (*messaging.Message, error) {
+	return &messaging.Message{Token: req.TargetIdentifier}, nil
+}
+
+func TestFCMMulticast(t *testing.T) {
+	client := &testFCMClient{invalid: map[string]bool{"token7": true, "token1100": true}}
+	fcm := NewFCM(testMessageBuilder, client)
+	var targets []string
+	for i := 0; i < 1201; i++ {
+		targets = append(targets, fmt.Sprintf("token%d", i))
+	}
+
+	err := fcm.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifiers: targets})
+	var merr *notify.MulticastError
+	assert.Assert(t, errors.As(err, &merr))
+	assert.Equal(t, client.sent, 1201)
+	assert.Assert(t, client.maxRunning <= fcmConcurrency)
+	assert.Equal(t, len(merr.Sent), 1199)
+	assert.Equal(t, len(merr.Failed), 2)
+	assert.Equal(t, merr.Failed[0].TargetIdentifier, "token7")
+	assert.Equal(t, merr.Failed[1].TargetIdentifier, "token1100")
+}
+
+// rewriteTransport sends all the requests to a test server.
+type rewriteTransport struct {
+	target *url.URL
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = t.target.Scheme
+	req.URL.Host = t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFCMErrors(t *testing.T) {
+	responses := map[string]struct {
+		status int
+		body   string
+	}{
+		"unregistered": {404, `{"error": {"status": "NOT_FOUND", "details": [{"@type": "type.googleapis.com/google.firebase.fcm.v1.FcmError", "errorCode": "UNREGISTERED"}]}}`},
+		"invalid":      {400, `{"error": {"status": "INVALID_ARGUMENT"}}`},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Message struct {
+				Token string `json:"token"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		res := responses[body.Message.Token]
+		w.WriteHeader(res.status)
+		w.Write([]byte(res.body))
+	}))
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	app, err := firebase.NewApp(context.Background(), &firebase.Config{ProjectID: "test"},
+		option.WithHTTPClient(&http.Client{Transport: &rewriteTransport{target: target}}))
+	assert.NilError(t, err)
+	client, err := app.Messaging(context.Background())
+	assert.NilError(t, err)
+	fcm := NewFCM(testMessageBuilder, client)
+
+	err = fcm.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "unregistered"})
+	var fcmErr *FCMError
+	assert.Assert(t, errors.As(err, &fcmErr))
+	assert.Equal(t, fcmErr.Code, FCMRegistrationTokenNotRegistered)
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = fcm.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "invalid"})
+	assert.Assert(t, errors.As(err, &fcmErr))
+	assert.Equal(t, fcmErr.Code, FCMInvalidArgument)
+	assert.Assert(t, !notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = newFCMError(errors.New("connection reset"))
+	assert.Assert(t, errors.As(err, &fcmErr))
+	assert.Equal(t, fcmErr.Code, FCMUnknownError)
+	assert.Assert(t, notify.IsRetryable(err))
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/breez/notify/notify"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+const (
+	HuaweiTokenURL = "https://oauth-login.cloud.huawei.com/oauth2/v3/token"
+	HuaweiEndpoint = "https://push-api.cloud.huawei.com"
+)
+
+// The Push Kit result codes.
+const (
+	HuaweiSuccess             = "80000000"
+	HuaweiPartialSuccess      = "80100000"
+	HuaweiInvalidParameters   = "80100001"
+	HuaweiInvalidMessage      = "80100003"
+	HuaweiAuthenticationError = "80200001"
+	HuaweiTokenExpired        = "80200003"
+	HuaweiNoPermission        = "80300002"
+	HuaweiInvalidTokens       = "80300007"
+	HuaweiMessageTooLarge     = "80300008"
+	HuaweiInternalError       = "81000001"
+)
+
+// HuaweiError is an error returned by Push Kit for a message. The invalid
+// tokens (80300007, and 80100000 for the single token of the message) match
+// notify.ErrInvalidToken. The internal errors (81000001), the rejected access
+// token (401), throttling (429) and the server errors are retried, the other
+// results are a rejected message or app and permanent.
+type HuaweiError struct {
+	StatusCode int
+	// Code is the Push Kit result code, empty when the response had none.
+	Code      string
+	Message   string
+	RequestID string
+}
+
+func (e *HuaweiError) Error() string {
+	return fmt.Sprintf("failed to send huawei message %v %v %v", e.StatusCode, e.Code, e.Message)
+}
+
+func (e *HuaweiError) Is(target error) bool {
+	// A partial success of a single token is the failure of that token.
+	return target == notify.ErrInvalidToken &&
+		(e.Code == HuaweiInvalidTokens || e.Code == HuaweiPartialSuccess)
+}
+
+func (e *HuaweiError) retryable() bool {
+	switch {
+	case e.Code == HuaweiInternalError,
+		e.StatusCode == http.StatusUnauthorized,
+		e.StatusCode == http.StatusTooManyRequests,
+		e.StatusCode >= http.StatusInternalServerError:
+		return true
+	}
+	return false
+}
+
+// HuaweiMessage is a Push Kit message, the message object of the send
+// request.
+type HuaweiMessage struct {
+	// Data is the payload of a data message, passed as is to the app.
+	Data         string               `json:"data,omitempty"`
+	Notification *HuaweiNotification  `json:"notification,omitempty"`
+	Android      *HuaweiAndroidConfig `json:"android,omitempty"`
+	Token        []string             `json:"token"`
+}
+
+type HuaweiNotification struct {
+	Title string `json:"title,omitempty"`
+	Body  string `json:"body,omitempty"`
+}
+
+type HuaweiAndroidConfig struct {
+	// Urgency is HIGH or NORMAL. The high priority data messages require
+	// the permission of the app.
+	Urgency string `json:"urgency,omitempty"`
+	// Category classifies the high priority messages.
+	Category string `json:"category,omitempty"`
+	// TTL is a duration in seconds, e.g. "86400s".
+	TTL         string `json:"ttl,omitempty"`
+	CollapseKey int    `json:"collapse_key,omitempty"`
+}
+
+type HuaweiMessageBuilder func(req *notify.Notification) (*HuaweiMessage, error)
+
+// HuaweiConfig configures the Huawei service.
+type HuaweiConfig struct {
+	// AppID defaults to ClientID, which it is for most apps.
+	AppID        string
+	ClientID     string
+	ClientSecret string
+	// TokenURL defaults to HuaweiTokenURL.
+	TokenURL string
+	// Endpoint defaults to HuaweiEndpoint.
+	Endpoint string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Huawei sends the notifications to the Android devices without Google
+// services with Huawei Push Kit. The access token of the client credentials
+// is cached until it expires or Push Kit rejects it.
+type Huawei struct {
+	messageBuilder HuaweiMessageBuilder
+	config         HuaweiConfig
+	credentials    clientcredentials.Config
+
+	mu     sync.Mutex
+	tokens oauth2.TokenSource
+}
+
+func NewHuawei(messageBuilder HuaweiMessageBuilder, config HuaweiConfig) *Huawei {
+	if config.AppID == "" {
+		config.AppID = config.ClientID
+	}
+	if config.TokenURL == "" {
+		config.TokenURL = HuaweiTokenURL
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = HuaweiEndpoint
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Huawei{
+		messageBuilder: messageBuilder,
+		config:         config,
+		credentials: clientcredentials.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			TokenURL:     config.TokenURL,
+			AuthStyle:    oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+func (h *Huawei) Send(ctx context.Context, req *notify.Notification) error {
+	message, err := h.messageBuilder(req)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if message == nil {
+		return ErrUnrecognizedTemplate
+	}
+	body, err := json.Marshal(map[string]interface{}{"message": message})
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to marshal huawei message %v", err))
+	}
+
+	token, err := h.token()
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%v/v1/%v/messages:send", h.config.Endpoint, url.PathEscape(h.config.AppID))
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create huawei request %v", err))
+	}
+	request.Header.Set("Content-Type", "application/json")
+	token.SetAuthHeader(request)
+
+	res, err := h.config.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send huawei message %w", err)
+	}
+	defer res.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	var result struct {
+		Code      string `json:"code"`
+		Msg       string `json:"msg"`
+		RequestID string `json:"requestId"`
+	}
+	json.Unmarshal(data, &result)
+	if res.StatusCode == http.StatusOK && result.Code == HuaweiSuccess {
+		notify.Logger(ctx).Debug("sent huawei message", "huawei_request_id", result.RequestID)
+		return nil
+	}
+
+	huaweiErr := &HuaweiError{
+		StatusCode: res.StatusCode,
+		Code:       result.Code,
+		Message:    result.Msg,
+		RequestID:  result.RequestID,
+	}
+	if result.Code == "" && result.Msg == "" {
+		huaweiErr.Message = string(data)
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		// Fetches a new access token on the next send.
+		h.resetToken()
+	}
+	if huaweiErr.retryable() {
+		return huaweiErr
+	}
+	return notify.Permanent(huaweiErr)
+}
+
+// token returns the cached access token, fetching a new one when it
+// expired.
+func (h *Huawei) token() (*oauth2.Token, error) {
+	h.mu.Lock()
+	if h.tokens == nil {
+		// The token source outlives the sends, so it gets no send context.
+		ctx := context.WithValue(context.Background(), oauth2.HTTPClient, h.config.Client)
+		h.tokens = h.credentials.TokenSource(ctx)
+	}
+	tokens := h.tokens
+	h.mu.Unlock()
+
+	token, err := tokens.Token()
+	if err != nil {
+		err = fmt.Errorf("failed to get huawei access token %w", err)
+		// Rejected credentials will be rejected again.
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) && retrieveErr.Response.StatusCode != http.StatusTooManyRequests &&
+			retrieveErr.Response.StatusCode < http.StatusInternalServerError {
+			return nil, notify.Permanent(err)
+		}
+		return nil, err
+	}
+	return token, nil
+}
+
+func (h *Huawei) resetToken() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = nil
+}
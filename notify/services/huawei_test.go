@@ -0,0 +1,113 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+func TestHuawei(t *testing.T) {
+	var tokensIssued int32
+	messages := make(chan *HuaweiMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/v3/token" {
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "app" || r.Form.Get("client_secret") != "secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			issued := atomic.AddInt32(&tokensIssued, 1)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"token%v","expires_in":3600,"token_type":"Bearer"}`, issued)
+			return
+		}
+		if r.URL.Path != "/v1/app/messages:send" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var body struct {
+			Message *HuaweiMessage `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		switch {
+		case body.Message.Token[0] == "expired" && r.Header.Get("Authorization") == "Bearer token1":
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"code":"80200003","msg":"OAuth token expired"}`)
+		case r.Header.Get("Authorization") == "":
+			w.WriteHeader(http.StatusUnauthorized)
+		case body.Message.Token[0] == "invalid":
+			fmt.Fprint(w, `{"code":"80300007","msg":"All the tokens are invalid","requestId":"2"}`)
+		case body.Message.Token[0] == "busy":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			messages <- body.Message
+			fmt.Fprint(w, `{"code":"80000000","msg":"Success","requestId":"1"}`)
+		}
+	}))
+	defer server.Close()
+
+	builder := testBuilder(func(req *notify.Notification) *HuaweiMessage {
+		return &HuaweiMessage{
+			Data:    `{"notification_type":"` + req.Template + `"}`,
+			Android: &HuaweiAndroidConfig{Urgency: "HIGH"},
+			Token:   []string{req.TargetIdentifier},
+		}
+	})
+	huawei := NewHuawei(builder, HuaweiConfig{
+		ClientID:     "app",
+		ClientSecret: "secret",
+		TokenURL:     server.URL + "/oauth2/v3/token",
+		Endpoint:     server.URL,
+	})
+
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, huawei.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "device"}))
+		message := <-messages
+		assert.Equal(t, message.Data, `{"notification_type":"t1"}`)
+		assert.Equal(t, message.Android.Urgency, "HIGH")
+		assert.DeepEqual(t, message.Token, []string{"device"})
+	}
+	// The access token is cached.
+	assert.Equal(t, atomic.LoadInt32(&tokensIssued), int32(1))
+
+	// A send rejected with HuaweiTokenExpired fails retryable and drops the
+	// cached access token, so the next send fetches a new one.
+	err := huawei.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "expired"})
+	var huaweiErr *HuaweiError
+	assert.Assert(t, errors.As(err, &huaweiErr))
+	assert.Equal(t, huaweiErr.Code, HuaweiTokenExpired)
+	assert.Assert(t, notify.IsRetryable(err))
+	assert.NilError(t, huawei.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "expired"}))
+	<-messages
+	assert.Equal(t, atomic.LoadInt32(&tokensIssued), int32(2))
+
+	err = huawei.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "invalid"})
+	assert.Assert(t, errors.As(err, &huaweiErr))
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = huawei.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "busy"})
+	assert.Assert(t, errors.As(err, &huaweiErr))
+	assert.Assert(t, notify.IsRetryable(err))
+
+	assertUnrecognizedTemplate(t, huawei, "device")
+
+	// Rejected credentials are not retried.
+	rejected := NewHuawei(builder, HuaweiConfig{
+		ClientID:     "app",
+		ClientSecret: "wrong",
+		TokenURL:     server.URL + "/oauth2/v3/token",
+		Endpoint:     server.URL,
+	})
+	err = rejected.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "device"})
+	assert.Assert(t, notify.IsPermanent(err))
+	assert.Assert(t, !notify.IsInvalidToken(err))
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+)
+
+const (
+	defaultLiveBufferSize = 100
+	defaultLiveBufferTTL  = 5 * time.Minute
+)
+
+// LiveConfig configures the Live service.
+type LiveConfig struct {
+	// Secret is the key of the HMAC-SHA256 tokens the clients connect with.
+	Secret []byte
+	// BufferSize bounds the messages kept for an identifier while it is not
+	// connected, and the messages waiting to be written to a connection.
+	// Defaults to 100.
+	BufferSize int
+	// BufferTTL is how long the messages are kept for an identifier that is
+	// not connected. Defaults to 5 minutes.
+	BufferTTL time.Duration
+}
+
+// Live delivers the notifications over the live connections of the clients
+// that have no push token, such as the desktop and server SDK instances. The
+// target identifier is the identifier the client connected with.
+//
+// A notification is written to all the connections of its target. When the
+// target is not connected it is buffered, and written once the target
+// connects again within the buffer TTL. The connections are held by this
+// process only, so the instances behind a load balancer need sticky
+// connections.
+type Live struct {
+	config LiveConfig
+
+	mu          sync.Mutex
+	connections map[string]map[*LiveConnection]struct{}
+	buffers     map[string]*liveBuffer
+	closed      bool
+}
+
+func NewLive(config LiveConfig) *Live {
+	if config.BufferSize <= 0 {
+		config.BufferSize = defaultLiveBufferSize
+	}
+	if config.BufferTTL <= 0 {
+		config.BufferTTL = defaultLiveBufferTTL
+	}
+	return &Live{
+		config:      config,
+		connections: make(map[string]map[*LiveConnection]struct{}),
+		buffers:     make(map[string]*liveBuffer),
+	}
+}
+
+// LiveToken returns the token an identifier connects with.
+func LiveToken(secret []byte, identifier string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(identifier))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Authenticate reports whether the token is the one of the identifier.
+func (l *Live) Authenticate(identifier, token string) bool {
+	return identifier != "" && hmac.Equal([]byte(token), []byte(LiveToken(l.config.Secret, identifier)))
+}
+
+// Send writes the notification, in the envelope of the webhooks, to the
+// connections of its target or buffers it. Once the service is closed it
+// returns notify.ErrShuttingDown, which is retried.
+func (l *Live) Send(ctx context.Context, req *notify.Notification) error {
+	message := &WebhookEnvelope{
+		DeliveryID:     notify.DeliveryID(ctx),
+		Template:       req.Template,
+		DisplayMessage: req.DisplayMessage,
+		AppData:        req.AppData,
+		Data:           req.Data,
+		Timestamp:      time.Now().Unix(),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return notify.ErrShuttingDown
+	}
+	delivered := false
+	for conn := range l.connections[req.TargetIdentifier] {
+		select {
+		case conn.messages <- message:
+			delivered = true
+		default:
+			// The client doesn't keep up, it will get the buffered
+			// messages when it connects again.
+			notify.Logger(ctx).Warn("dropping slow live connection", "connection_id", conn.id)
+			l.remove(conn)
+		}
+	}
+	if !delivered {
+		l.buffer(ctx, req.TargetIdentifier, message)
+	}
+	return nil
+}
+
+// Connect registers a connection of the identifier. The messages buffered
+// for it are written to the connection first.
+func (l *Live) Connect(identifier string) *LiveConnection {
+	conn := &LiveConnection{
+		id:         newLiveConnectionID(),
+		identifier: identifier,
+		live:       l,
+		messages:   make(chan *WebhookEnvelope, l.config.BufferSize),
+		done:       make(chan struct{}),
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		close(conn.done)
+		return conn
+	}
+	if buffer, ok := l.buffers[identifier]; ok {
+		buffer.timer.Stop()
+		delete(l.buffers, identifier)
+		now := time.Now()
+		for _, m := range buffer.messages {
+			if now.Before(m.expires) {
+				conn.messages <- m.message
+			}
+		}
+	}
+	if l.connections[identifier] == nil {
+		l.connections[identifier] = make(map[*LiveConnection]struct{})
+	}
+	l.connections[identifier][conn] = struct{}{}
+	return conn
+}
+
+// Connections returns the number of open connections.
+func (l *Live) Connections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	count := 0
+	for _, conns := range l.connections {
+		count += len(conns)
+	}
+	return count
+}
+
+// Close ends all the connections and stops buffering, on shutdown.
+func (l *Live) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	for _, conns := range l.connections {
+		for conn := range conns {
+			l.remove(conn)
+		}
+	}
+	for identifier, buffer := range l.buffers {
+		buffer.timer.Stop()
+		delete(l.buffers, identifier)
+	}
+}
+
+// buffer keeps the message until the identifier connects. It is called with
+// mu held.
+func (l *Live) buffer(ctx context.Context, identifier string, message *WebhookEnvelope) {
+	buffer, ok := l.buffers[identifier]
+	if !ok {
+		buffer = &liveBuffer{}
+		l.buffers[identifier] = buffer
+		buffer.timer = time.AfterFunc(l.config.BufferTTL, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.buffers[identifier] == buffer {
+				delete(l.buffers, identifier)
+			}
+		})
+	} else {
+		// The newest message expires last, so the whole buffer is dropped
+		// with it.
+		buffer.timer.Reset(l.config.BufferTTL)
+	}
+	if len(buffer.messages) == l.config.BufferSize {
+		notify.Logger(ctx).Warn("live buffer is full, dropping the oldest message", "dropped_delivery_id", buffer.messages[0].message.DeliveryID)
+		buffer.messages = buffer.messages[1:]
+	}
+	buffer.messages = append(buffer.messages, bufferedLiveMessage{
+		message: message,
+		expires: time.Now().Add(l.config.BufferTTL),
+	})
+}
+
+// remove unregisters the connection and ends it. The messages it failed to
+// write and the ones it didn't take yet are buffered again when the
+// identifier has no other connection. It is called with mu held.
+func (l *Live) remove(conn *LiveConnection) {
+	conns, ok := l.connections[conn.identifier]
+	if !ok {
+		return
+	}
+	if _, ok := conns[conn]; !ok {
+		return
+	}
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(l.connections, conn.identifier)
+	}
+	close(conn.done)
+	if len(conns) == 0 && !l.closed {
+		for _, message := range conn.unwritten {
+			l.buffer(context.Background(), conn.identifier, message)
+		}
+	}
+	conn.unwritten = nil
+	for {
+		select {
+		case message := <-conn.messages:
+			if len(conns) == 0 && !l.closed {
+				l.buffer(context.Background(), conn.identifier, message)
+			}
+		default:
+			return
+		}
+	}
+}
+
+type liveBuffer struct {
+	messages []bufferedLiveMessage
+	timer    *time.Timer
+}
+
+type bufferedLiveMessage struct {
+	message *WebhookEnvelope
+	expires time.Time
+}
+
+// LiveConnection is a connection of a client, which writes its messages
+// until it is closed.
+type LiveConnection struct {
+	id         string
+	identifier string
+	live       *Live
+	messages   chan *WebhookEnvelope
+	done       chan struct{}
+	// unwritten are the messages taken from messages that failed to be
+	// written, guarded by the mu of live.
+	unwritten []*WebhookEnvelope
+}
+
+// Messages returns the messages to write to the client.
+func (c *LiveConnection) Messages() <-chan *WebhookEnvelope {
+	return c.messages
+}
+
+// Done is closed when the connection is ended by the service, because the
+// client is too slow or on shutdown.
+func (c *LiveConnection) Done() <-chan struct{} {
+	return c.done
+}
+
+// Requeue gives back a message taken from Messages that failed to be
+// written, so it is buffered for the next connection of the identifier
+// rather than lost.
+func (c *LiveConnection) Requeue(message *WebhookEnvelope) {
+	c.live.mu.Lock()
+	defer c.live.mu.Unlock()
+	if _, ok := c.live.connections[c.identifier][c]; ok {
+		c.unwritten = append(c.unwritten, message)
+		return
+	}
+	// The connection was already removed, the message is buffered unless
+	// another connection of the identifier got it.
+	if len(c.live.connections[c.identifier]) == 0 && !c.live.closed {
+		c.live.buffer(context.Background(), c.identifier, message)
+	}
+}
+
+// Close unregisters the connection once the client is gone.
+func (c *LiveConnection) Close() {
+	c.live.mu.Lock()
+	defer c.live.mu.Unlock()
+	c.live.remove(c)
+}
+
+func newLiveConnectionID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,75 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+func TestLive(t *testing.T) {
+	secret := []byte("secret")
+	live := NewLive(LiveConfig{Secret: secret, BufferSize: 2, BufferTTL: time.Minute})
+	defer live.Close()
+	assert.Assert(t, live.Authenticate("id1", LiveToken(secret, "id1")))
+	assert.Assert(t, !live.Authenticate("id2", LiveToken(secret, "id1")))
+
+	conn := live.Connect("id1")
+	assert.NilError(t, live.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "id1"}))
+	assert.Equal(t, (<-conn.Messages()).Template, "t1")
+	conn.Close()
+	assert.Equal(t, live.Connections(), 0)
+
+	// The messages are buffered while disconnected, the oldest are dropped
+	// when the buffer is full.
+	for _, template := range []string{"t2", "t3", "t4"} {
+		assert.NilError(t, live.Send(context.Background(), &notify.Notification{Template: template, TargetIdentifier: "id1"}))
+	}
+	conn = live.Connect("id1")
+	assert.Equal(t, (<-conn.Messages()).Template, "t3")
+	assert.Equal(t, (<-conn.Messages()).Template, "t4")
+
+	// A slow connection is dropped and its messages buffered again.
+	for _, template := range []string{"t5", "t6", "t7"} {
+		assert.NilError(t, live.Send(context.Background(), &notify.Notification{Template: template, TargetIdentifier: "id1"}))
+	}
+	<-conn.Done()
+	conn = live.Connect("id1")
+	assert.Equal(t, (<-conn.Messages()).Template, "t6")
+	assert.Equal(t, (<-conn.Messages()).Template, "t7")
+
+	// A message that failed to be written is buffered again, before the
+	// ones the connection didn't take.
+	for _, template := range []string{"t8", "t9"} {
+		assert.NilError(t, live.Send(context.Background(), &notify.Notification{Template: template, TargetIdentifier: "id1"}))
+	}
+	conn.Requeue(<-conn.Messages())
+	conn.Close()
+	conn = live.Connect("id1")
+	assert.Equal(t, (<-conn.Messages()).Template, "t8")
+	assert.Equal(t, (<-conn.Messages()).Template, "t9")
+
+	// Once closed the notifications are not accepted anymore, so they are
+	// retried rather than lost.
+	closed := NewLive(LiveConfig{Secret: secret})
+	closed.Close()
+	err := closed.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "id1"})
+	assert.ErrorIs(t, err, notify.ErrShuttingDown)
+	assert.Assert(t, notify.IsRetryable(err))
+
+	// The buffers expire.
+	expiring := NewLive(LiveConfig{Secret: secret, BufferTTL: 10 * time.Millisecond})
+	assert.NilError(t, expiring.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "id1"}))
+	time.Sleep(50 * time.Millisecond)
+	conn = expiring.Connect("id1")
+	select {
+	case message := <-conn.Messages():
+		t.Fatalf("unexpected message %v", message.Template)
+	default:
+	}
+
+	expiring.Close()
+	<-conn.Done()
+}
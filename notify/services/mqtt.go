@@ -0,0 +1,171 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	defaultMQTTTopicPrefix = "notify/"
+	defaultMQTTTimeout     = 10 * time.Second
+)
+
+var ErrInvalidTopic = notify.Permanent(fmt.Errorf("%w: invalid mqtt topic", notify.ErrInvalidToken))
+
+// MQTTMessage is the payload published to the topic of a target.
+type MQTTMessage struct {
+	Payload []byte
+}
+
+type MQTTMessageBuilder func(req *notify.Notification) (*MQTTMessage, error)
+
+// MQTTConfig configures the MQTT service.
+type MQTTConfig struct {
+	// Broker is the url of the broker, e.g. tcp://host:1883 or
+	// ssl://host:8883.
+	Broker   string
+	Username string
+	Password string
+	// ClientID defaults to a random one, so the instances don't take over
+	// the sessions of each other.
+	ClientID string
+	// TopicPrefix is prepended to the target identifier to get its topic.
+	// Defaults to "notify/".
+	TopicPrefix string
+	// QoS is the quality of service of the messages, 0 (at most once), 1
+	// (at least once) or 2 (exactly once).
+	QoS byte
+	// Retained keeps the last message of every topic on the broker, for the
+	// devices that subscribe after it was published.
+	Retained bool
+	// Timeout bounds the connection and the acknowledgement of every
+	// message. Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// MQTT publishes the notifications to the topic of their target, the topic
+// prefix followed by the target identifier, for the devices that subscribe
+// to a broker rather than getting push notifications.
+//
+// The connection to the broker is opened on the first send and again on the
+// send following a disconnection.
+type MQTT struct {
+	messageBuilder MQTTMessageBuilder
+	config         MQTTConfig
+
+	mu        sync.Mutex
+	client    mqtt.Client
+	connected bool
+}
+
+func NewMQTT(messageBuilder MQTTMessageBuilder, config MQTTConfig) (*MQTT, error) {
+	if config.Broker == "" {
+		return nil, errors.New("no mqtt broker configured")
+	}
+	if config.QoS > 2 {
+		return nil, fmt.Errorf("invalid mqtt qos %v", config.QoS)
+	}
+	if config.ClientID == "" {
+		var b [8]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		config.ClientID = "notify-" + hex.EncodeToString(b[:])
+	}
+	if config.TopicPrefix == "" {
+		config.TopicPrefix = defaultMQTTTopicPrefix
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultMQTTTimeout
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetConnectTimeout(config.Timeout).
+		SetWriteTimeout(config.Timeout).
+		SetAutoReconnect(false)
+	m := &MQTT{
+		messageBuilder: messageBuilder,
+		config:         config,
+	}
+	// The handler runs once the client is disconnected, when it can connect
+	// again.
+	options.SetConnectionLostHandler(func(mqtt.Client, error) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.connected = false
+	})
+	m.client = mqtt.NewClient(options)
+	return m, nil
+}
+
+func (m *MQTT) Send(ctx context.Context, req *notify.Notification) error {
+	// A target can't subscribe to the topics of others with the wildcards.
+	if req.TargetIdentifier == "" || strings.ContainsAny(req.TargetIdentifier, "/+#\x00") {
+		return ErrInvalidTopic
+	}
+	message, err := m.messageBuilder(req)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if message == nil {
+		return ErrUnrecognizedTemplate
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.config.Timeout)
+	defer cancel()
+	if err := m.connect(ctx); err != nil {
+		return err
+	}
+	token := m.client.Publish(m.config.TopicPrefix+req.TargetIdentifier, m.config.QoS, m.config.Retained, message.Payload)
+	if err := waitMQTT(ctx, token); err != nil {
+		return fmt.Errorf("failed to publish mqtt message %w", err)
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (m *MQTT) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.connected {
+		m.client.Disconnect(uint(m.config.Timeout / time.Millisecond))
+		m.connected = false
+	}
+}
+
+// connect opens the connection to the broker when it is not open.
+func (m *MQTT) connect(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The client may have connected after an earlier send stopped waiting.
+	if m.connected || m.client.IsConnectionOpen() {
+		m.connected = true
+		return nil
+	}
+	if err := waitMQTT(ctx, m.client.Connect()); err != nil {
+		return fmt.Errorf("failed to connect to mqtt broker %w", err)
+	}
+	m.connected = true
+	return nil
+}
+
+func waitMQTT(ctx context.Context, token mqtt.Token) error {
+	select {
+	case <-token.Done():
+		return token.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/breez/notify/notify"
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"gotest.tools/v3/assert"
+)
+
+// testBroker is an embedded broker acknowledging the published messages
+// with their quality of service.
+type testBroker struct {
+	listener  net.Listener
+	published chan *packets.PublishPacket
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	broker := &testBroker{listener: listener, published: make(chan *packets.PublishPacket, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			broker.mu.Lock()
+			broker.conns = append(broker.conns, conn)
+			broker.mu.Unlock()
+			go broker.serve(conn)
+		}
+	}()
+	return broker
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch p := packet.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.published <- p
+			switch p.Qos {
+			case 1:
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			case 2:
+				rec := packets.NewControlPacket(packets.Pubrec).(*packets.PubrecPacket)
+				rec.MessageID = p.MessageID
+				reply = rec
+			}
+		case *packets.PubrelPacket:
+			comp := packets.NewControlPacket(packets.Pubcomp).(*packets.PubcompPacket)
+			comp.MessageID = p.MessageID
+			reply = comp
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// drop closes the connections of the clients.
+func (b *testBroker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, conn := range b.conns {
+		conn.Close()
+	}
+	b.conns = nil
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func TestMQTT(t *testing.T) {
+	broker := newTestBroker(t)
+	defer broker.listener.Close()
+
+	builder := testBuilder(func(req *notify.Notification) *MQTTMessage {
+		return &MQTTMessage{Payload: []byte(`{"notification_type":"` + req.Template + `"}`)}
+	})
+	for _, qos := range []byte{0, 1, 2} {
+		service, err := NewMQTT(builder, MQTTConfig{Broker: broker.url(), QoS: qos, Retained: qos == 1})
+		assert.NilError(t, err)
+		assert.NilError(t, service.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "pos1"}))
+		published := <-broker.published
+		assert.Equal(t, published.TopicName, "notify/pos1")
+		assert.Equal(t, published.Qos, qos)
+		assert.Equal(t, published.Retain, qos == 1)
+		assert.Equal(t, string(published.Payload), `{"notification_type":"t1"}`)
+		service.Close()
+	}
+
+	service, err := NewMQTT(builder, MQTTConfig{Broker: broker.url(), QoS: 1, TopicPrefix: "pos/"})
+	assert.NilError(t, err)
+	defer service.Close()
+	assert.NilError(t, service.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "pos1"}))
+	assert.Equal(t, (<-broker.published).TopicName, "pos/pos1")
+
+	// The connection is opened again after the broker dropped it.
+	broker.drop()
+	for {
+		service.mu.Lock()
+		connected := service.connected
+		service.mu.Unlock()
+		if !connected {
+			break
+		}
+		runtime.Gosched()
+	}
+	assert.NilError(t, service.Send(context.Background(), &notify.Notification{Template: "t2", TargetIdentifier: "pos1"}))
+	assert.Equal(t, string((<-broker.published).Payload), `{"notification_type":"t2"}`)
+
+	err = service.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "pos/#"})
+	assert.ErrorIs(t, err, ErrInvalidTopic)
+	assert.Assert(t, notify.IsInvalidToken(err))
+
+	assertUnrecognizedTemplate(t, service, "pos1")
+
+	// A broker that is down is retried.
+	down, err := NewMQTT(builder, MQTTConfig{Broker: "tcp://127.0.0.1:1"})
+	assert.NilError(t, err)
+	err = down.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "pos1"})
+	assert.Assert(t, err != nil)
+	assert.Assert(t, notify.IsRetryable(err))
+
+	_, err = NewMQTT(builder, MQTTConfig{Broker: broker.url(), QoS: 3})
+	assert.ErrorContains(t, err, "invalid mqtt qos")
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	nip44Version      = 2
+	nip44MaxPlaintext = 65535
+)
+
+// nip44ConversationKey returns the key shared by the sender and the
+// receiver of NIP-44 v2 messages.
+func nip44ConversationKey(private *btcec.PrivateKey, public *btcec.PublicKey) []byte {
+	shared := btcec.GenerateSharedSecret(private, public)
+	return hkdf.Extract(sha256.New, shared, []byte("nip44-v2"))
+}
+
+// nip44Encrypt encrypts the plaintext with the conversation key as the
+// base64 payload of NIP-44 v2. A random nonce is used when nonce is nil.
+func nip44Encrypt(conversationKey []byte, plaintext []byte, nonce []byte) (string, error) {
+	if len(plaintext) == 0 || len(plaintext) > nip44MaxPlaintext {
+		return "", errors.New("invalid nip44 plaintext length")
+	}
+	if nonce == nil {
+		nonce = make([]byte, 32)
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+	}
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	padded := make([]byte, 2+nip44PaddedLen(len(plaintext)))
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	ciphertext := make([]byte, len(padded))
+	cipher.XORKeyStream(ciphertext, padded)
+
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+
+	payload := make([]byte, 0, 1+len(nonce)+len(ciphertext)+sha256.Size)
+	payload = append(payload, nip44Version)
+	payload = append(payload, nonce...)
+	payload = append(payload, ciphertext...)
+	payload = mac.Sum(payload)
+	return base64.StdEncoding.EncodeToString(payload), nil
+}
+
+func nip44MessageKeys(conversationKey []byte, nonce []byte) (chachaKey, chachaNonce, hmacKey []byte, err error) {
+	keys := make([]byte, 76)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, conversationKey, nonce), keys); err != nil {
+		return nil, nil, nil, err
+	}
+	return keys[:32], keys[32:44], keys[44:], nil
+}
+
+// nip44PaddedLen rounds the plaintext length up, so the length of the
+// messages leaks less about their content.
+func nip44PaddedLen(length int) int {
+	if length <= 32 {
+		return 32
+	}
+	nextPower := 1 << bits.Len(uint(length-1))
+	chunk := 32
+	if nextPower > 256 {
+		chunk = nextPower / 8
+	}
+	return chunk * ((length-1)/chunk + 1)
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec/v2"
+	"golang.org/x/crypto/chacha20"
+	"gotest.tools/v3/assert"
+)
+
+// nip44Decrypt decrypts a NIP-44 v2 payload, as the receiver does.
+func nip44Decrypt(conversationKey []byte, payload string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil || len(data) < 99 || data[0] != nip44Version {
+		return "", errors.New("invalid payload")
+	}
+	nonce, ciphertext, sum := data[1:33], data[33:len(data)-32], data[len(data)-32:]
+	chachaKey, chachaNonce, hmacKey, err := nip44MessageKeys(conversationKey, nonce)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, hmacKey)
+	mac.Write(nonce)
+	mac.Write(ciphertext)
+	if !hmac.Equal(mac.Sum(nil), sum) {
+		return "", errors.New("invalid mac")
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(chachaKey, chachaNonce)
+	if err != nil {
+		return "", err
+	}
+	padded := make([]byte, len(ciphertext))
+	cipher.XORKeyStream(padded, ciphertext)
+	length := int(binary.BigEndian.Uint16(padded))
+	if length == 0 || 2+length > len(padded) || len(padded)-2 != nip44PaddedLen(length) {
+		return "", errors.New("invalid padding")
+	}
+	return string(padded[2 : 2+length]), nil
+}
+
+func testKey(t *testing.T, hexKey string) *btcec.PrivateKey {
+	b, err := hex.DecodeString(hexKey)
+	assert.NilError(t, err)
+	private, _ := btcec.PrivKeyFromBytes(b)
+	return private
+}
+
+// The first encrypt_decrypt vector of the NIP-44 specification.
+func TestNIP44(t *testing.T) {
+	sec1 := testKey(t, strings.Repeat("0", 63)+"1")
+	sec2 := testKey(t, strings.Repeat("0", 63)+"2")
+	conversationKey := nip44ConversationKey(sec1, sec2.PubKey())
+	assert.Equal(t, hex.EncodeToString(conversationKey), "c41c775356fd92eadc63ff5a0dc1da211b268cbea22316767095b2871ea1412d")
+	assert.DeepEqual(t, nip44ConversationKey(sec2, sec1.PubKey()), conversationKey)
+
+	nonce, _ := hex.DecodeString(strings.Repeat("0", 63) + "1")
+	payload, err := nip44Encrypt(conversationKey, []byte("a"), nonce)
+	assert.NilError(t, err)
+	assert.Equal(t, payload, "AgAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAABee0G5VSK0/9YypIObAtDKfYEAjD35uVkHyB0F4DwrcNaCXlCWZKaArsGrY6M9wnuTMxWfp1RTN9Xga8no+kF5Vsb")
+	plaintext, err := nip44Decrypt(conversationKey, payload)
+	assert.NilError(t, err)
+	assert.Equal(t, plaintext, "a")
+
+	for length, padded := range map[int]int{1: 32, 32: 32, 33: 64, 257: 320, 1025: 1280, 65535: 65536} {
+		assert.Equal(t, nip44PaddedLen(length), padded, "length %v", length)
+	}
+}
@@ -0,0 +1,379 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// NostrNotificationKind is the kind of the NIP-47 notification events
+	// encrypted with NIP-44.
+	NostrNotificationKind = 23197
+
+	defaultNostrAckTimeout  = 10 * time.Second
+	defaultNostrDialTimeout = 10 * time.Second
+)
+
+var (
+	ErrInvalidPubkey = notify.Permanent(fmt.Errorf("%w: invalid nostr pubkey", notify.ErrInvalidToken))
+	errRelayClosed   = errors.New("relay connection closed")
+)
+
+// The machine readable prefixes of the messages of the rejected events that
+// will be rejected again.
+var nostrPermanentPrefixes = []string{"invalid:", "blocked:", "restricted:", "pow:"}
+
+// NostrError is returned when no relay accepted the event. It is permanent
+// when all the relays rejected it for good.
+type NostrError struct {
+	// Relays maps the relay urls to their error.
+	Relays map[string]string
+}
+
+func (e *NostrError) Error() string {
+	var relays []string
+	for relay, err := range e.Relays {
+		relays = append(relays, relay+": "+err)
+	}
+	sort.Strings(relays)
+	return fmt.Sprintf("failed to publish nostr event %v", strings.Join(relays, ", "))
+}
+
+// NostrMessage is the content of the event to a target pubkey.
+type NostrMessage struct {
+	// Content is encrypted with NIP-44 for the target.
+	Content []byte
+	// Kind defaults to the kind of the service.
+	Kind int
+	// Tags are added to the p tag of the target.
+	Tags [][]string
+}
+
+type NostrMessageBuilder func(req *notify.Notification) (*NostrMessage, error)
+
+// NostrConfig configures the Nostr service.
+type NostrConfig struct {
+	// PrivateKey is the hex private key the events are signed with.
+	PrivateKey string
+	// Relays are the websocket urls of the relays the events are published
+	// to.
+	Relays []string
+	// Kind defaults to NostrNotificationKind.
+	Kind int
+	// AckTimeout bounds the wait for the OK of a relay. Defaults to 10
+	// seconds.
+	AckTimeout time.Duration
+}
+
+// NostrEvent is a signed nostr event.
+type NostrEvent struct {
+	ID        string     `json:"id"`
+	PubKey    string     `json:"pubkey"`
+	CreatedAt int64      `json:"created_at"`
+	Kind      int        `json:"kind"`
+	Tags      [][]string `json:"tags"`
+	Content   string     `json:"content"`
+	Sig       string     `json:"sig"`
+}
+
+// Nostr publishes the notifications as NIP-44 encrypted events to the
+// target pubkey, a hex public key, on all the configured relays. A
+// notification is sent once a relay acknowledged its event.
+type Nostr struct {
+	messageBuilder NostrMessageBuilder
+	key            *btcec.PrivateKey
+	pubKey         string
+	kind           int
+	ackTimeout     time.Duration
+	relays         []*nostrRelay
+}
+
+func NewNostr(messageBuilder NostrMessageBuilder, config NostrConfig) (*Nostr, error) {
+	b, err := hex.DecodeString(config.PrivateKey)
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("invalid nostr private key")
+	}
+	if len(config.Relays) == 0 {
+		return nil, errors.New("no nostr relays configured")
+	}
+	key, _ := btcec.PrivKeyFromBytes(b)
+	n := &Nostr{
+		messageBuilder: messageBuilder,
+		key:            key,
+		pubKey:         hex.EncodeToString(schnorr.SerializePubKey(key.PubKey())),
+		kind:           config.Kind,
+		ackTimeout:     config.AckTimeout,
+	}
+	if n.kind == 0 {
+		n.kind = NostrNotificationKind
+	}
+	if n.ackTimeout <= 0 {
+		n.ackTimeout = defaultNostrAckTimeout
+	}
+	for _, url := range config.Relays {
+		n.relays = append(n.relays, &nostrRelay{url: url, pending: make(map[string]chan nostrOK)})
+	}
+	return n, nil
+}
+
+// PubKey returns the hex public key the events are signed with.
+func (n *Nostr) PubKey() string {
+	return n.pubKey
+}
+
+func (n *Nostr) Send(ctx context.Context, req *notify.Notification) error {
+	target, err := parseNostrPubKey(req.TargetIdentifier)
+	if err != nil {
+		return err
+	}
+	message, err := n.messageBuilder(req)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if message == nil {
+		return ErrUnrecognizedTemplate
+	}
+	content, err := nip44Encrypt(nip44ConversationKey(n.key, target), message.Content, nil)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to encrypt nostr content %v", err))
+	}
+	kind := message.Kind
+	if kind == 0 {
+		kind = n.kind
+	}
+	event, err := n.sign(kind, append([][]string{{"p", req.TargetIdentifier}}, message.Tags...), content)
+	if err != nil {
+		return notify.Permanent(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, n.ackTimeout)
+	defer cancel()
+	type result struct {
+		relay string
+		ok    nostrOK
+		err   error
+	}
+	results := make(chan result, len(n.relays))
+	for _, relay := range n.relays {
+		go func(relay *nostrRelay) {
+			ok, err := relay.publish(ctx, event)
+			results <- result{relay: relay.url, ok: ok, err: err}
+		}(relay)
+	}
+
+	nostrErr := &NostrError{Relays: make(map[string]string)}
+	permanent := true
+	for range n.relays {
+		r := <-results
+		switch {
+		case r.err != nil:
+			nostrErr.Relays[r.relay] = r.err.Error()
+			permanent = false
+		case r.ok.accepted():
+			notify.Logger(ctx).Debug("published nostr event", "relay", r.relay, "event_id", event.ID)
+			return nil
+		default:
+			nostrErr.Relays[r.relay] = r.ok.message
+			permanent = permanent && r.ok.permanent()
+		}
+	}
+	if permanent {
+		return notify.Permanent(nostrErr)
+	}
+	return nostrErr
+}
+
+// Close closes the connections to the relays.
+func (n *Nostr) Close() {
+	for _, relay := range n.relays {
+		relay.close()
+	}
+}
+
+func (n *Nostr) sign(kind int, tags [][]string, content string) (*NostrEvent, error) {
+	event := &NostrEvent{
+		PubKey:    n.pubKey,
+		CreatedAt: time.Now().Unix(),
+		Kind:      kind,
+		Tags:      tags,
+		Content:   content,
+	}
+	serialized, err := json.Marshal([]interface{}{0, event.PubKey, event.CreatedAt, event.Kind, event.Tags, event.Content})
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize nostr event %w", err)
+	}
+	id := sha256.Sum256(serialized)
+	sig, err := schnorr.Sign(n.key, id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign nostr event %w", err)
+	}
+	event.ID = hex.EncodeToString(id[:])
+	event.Sig = hex.EncodeToString(sig.Serialize())
+	return event, nil
+}
+
+func parseNostrPubKey(target string) (*btcec.PublicKey, error) {
+	b, err := hex.DecodeString(target)
+	if err != nil || len(b) != 32 {
+		return nil, ErrInvalidPubkey
+	}
+	pubKey, err := schnorr.ParsePubKey(b)
+	if err != nil {
+		return nil, ErrInvalidPubkey
+	}
+	return pubKey, nil
+}
+
+// nostrOK is the OK message a relay answers an event with.
+type nostrOK struct {
+	ok      bool
+	message string
+}
+
+func (o nostrOK) accepted() bool {
+	return o.ok || strings.HasPrefix(o.message, "duplicate:")
+}
+
+func (o nostrOK) permanent() bool {
+	for _, prefix := range nostrPermanentPrefixes {
+		if strings.HasPrefix(o.message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// nostrRelay is a connection to a relay shared by the sends. It is opened
+// on the first send and again after it breaks.
+type nostrRelay struct {
+	url string
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	pending map[string]chan nostrOK
+}
+
+func (r *nostrRelay) publish(ctx context.Context, event *NostrEvent) (nostrOK, error) {
+	ack := make(chan nostrOK, 1)
+	r.mu.Lock()
+	conn, err := r.connect()
+	if err != nil {
+		r.mu.Unlock()
+		return nostrOK{}, err
+	}
+	r.pending[event.ID] = ack
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+	}
+	err = websocket.JSON.Send(conn, []interface{}{"EVENT", event})
+	if err != nil {
+		delete(r.pending, event.ID)
+		r.drop(conn)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return nostrOK{}, fmt.Errorf("failed to send event %w", err)
+	}
+
+	select {
+	case ok, open := <-ack:
+		if !open {
+			return nostrOK{}, errRelayClosed
+		}
+		return ok, nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		delete(r.pending, event.ID)
+		r.mu.Unlock()
+		return nostrOK{}, ctx.Err()
+	}
+}
+
+// connect returns the connection to the relay, dialing it when needed. It
+// is called with mu held.
+func (r *nostrRelay) connect() (*websocket.Conn, error) {
+	if r.conn != nil {
+		return r.conn, nil
+	}
+	config, err := websocket.NewConfig(r.url, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	config.Dialer = &net.Dialer{Timeout: defaultNostrDialTimeout}
+	conn, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to relay %w", err)
+	}
+	r.conn = conn
+	go r.read(conn)
+	return conn, nil
+}
+
+// read dispatches the OK messages of the relay to the waiting sends, until
+// the connection breaks.
+func (r *nostrRelay) read(conn *websocket.Conn) {
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			r.mu.Lock()
+			r.drop(conn)
+			r.mu.Unlock()
+			return
+		}
+		var message []json.RawMessage
+		var label string
+		if json.Unmarshal(data, &message) != nil || len(message) < 4 ||
+			json.Unmarshal(message[0], &label) != nil || label != "OK" {
+			continue
+		}
+		var id string
+		var ok nostrOK
+		if json.Unmarshal(message[1], &id) != nil ||
+			json.Unmarshal(message[2], &ok.ok) != nil ||
+			json.Unmarshal(message[3], &ok.message) != nil {
+			continue
+		}
+		r.mu.Lock()
+		if ack, found := r.pending[id]; found {
+			delete(r.pending, id)
+			ack <- ok
+		}
+		r.mu.Unlock()
+	}
+}
+
+// drop closes the connection and fails its pending sends. It is called with
+// mu held.
+func (r *nostrRelay) drop(conn *websocket.Conn) {
+	if r.conn != conn {
+		return
+	}
+	conn.Close()
+	r.conn = nil
+	for id, ack := range r.pending {
+		close(ack)
+		delete(r.pending, id)
+	}
+}
+
+func (r *nostrRelay) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn != nil {
+		r.drop(r.conn)
+	}
+}
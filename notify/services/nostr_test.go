@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/breez/notify/notify"
+	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
+	"golang.org/x/net/websocket"
+	"gotest.tools/v3/assert"
+)
+
+// testRelay is a local relay answering the events with the OK message
+// returned by accept.
+type testRelay struct {
+	server      *httptest.Server
+	url         string
+	connections int32
+	events      chan *NostrEvent
+}
+
+func newTestRelay(accept func(event *NostrEvent) (bool, string)) *testRelay {
+	relay := &testRelay{events: make(chan *NostrEvent, 10)}
+	relay.server = httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		atomic.AddInt32(&relay.connections, 1)
+		for {
+			var message []json.RawMessage
+			if err := websocket.JSON.Receive(conn, &message); err != nil {
+				return
+			}
+			var event NostrEvent
+			if len(message) != 2 || json.Unmarshal(message[1], &event) != nil {
+				continue
+			}
+			ok, reason := accept(&event)
+			if ok && !verifyNostrEvent(&event) {
+				ok, reason = false, "invalid: bad signature"
+			}
+			if ok {
+				relay.events <- &event
+			}
+			websocket.JSON.Send(conn, []interface{}{"OK", event.ID, ok, reason})
+		}
+	}))
+	relay.url = "ws" + strings.TrimPrefix(relay.server.URL, "http")
+	return relay
+}
+
+func verifyNostrEvent(event *NostrEvent) bool {
+	serialized, _ := json.Marshal([]interface{}{0, event.PubKey, event.CreatedAt, event.Kind, event.Tags, event.Content})
+	id := sha256.Sum256(serialized)
+	if hex.EncodeToString(id[:]) != event.ID {
+		return false
+	}
+	pubKey, err := hex.DecodeString(event.PubKey)
+	if err != nil {
+		return false
+	}
+	key, err := schnorr.ParsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	sig, err := hex.DecodeString(event.Sig)
+	if err != nil {
+		return false
+	}
+	signature, err := schnorr.ParseSignature(sig)
+	return err == nil && signature.Verify(id[:], key)
+}
+
+func TestNostr(t *testing.T) {
+	accepting := newTestRelay(func(event *NostrEvent) (bool, string) { return true, "" })
+	defer accepting.server.Close()
+	blocking := newTestRelay(func(event *NostrEvent) (bool, string) { return false, "blocked: not allowed" })
+	defer blocking.server.Close()
+
+	senderKey, err := btcec.NewPrivateKey()
+	assert.NilError(t, err)
+	receiverKey, err := btcec.NewPrivateKey()
+	assert.NilError(t, err)
+	receiver := hex.EncodeToString(schnorr.SerializePubKey(receiverKey.PubKey()))
+
+	builder := testBuilder(func(req *notify.Notification) *NostrMessage {
+		return &NostrMessage{Content: []byte(`{"notification_type":"` + req.Template + `"}`)}
+	})
+	nostr, err := NewNostr(builder, NostrConfig{
+		PrivateKey: hex.EncodeToString(senderKey.Serialize()),
+		Relays:     []string{accepting.url, blocking.url},
+	})
+	assert.NilError(t, err)
+	defer nostr.Close()
+
+	for i := 0; i < 2; i++ {
+		assert.NilError(t, nostr.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: receiver}))
+		event := <-accepting.events
+		assert.Equal(t, event.Kind, NostrNotificationKind)
+		assert.Equal(t, event.PubKey, nostr.PubKey())
+		assert.DeepEqual(t, event.Tags, [][]string{{"p", receiver}})
+		content, err := nip44Decrypt(nip44ConversationKey(receiverKey, senderKey.PubKey()), event.Content)
+		assert.NilError(t, err)
+		assert.Equal(t, content, `{"notification_type":"t1"}`)
+	}
+	// The connections are reused.
+	assert.Equal(t, atomic.LoadInt32(&accepting.connections), int32(1))
+
+	// Only the relay rejecting the events for good is left.
+	blockingOnly, err := NewNostr(builder, NostrConfig{
+		PrivateKey: hex.EncodeToString(senderKey.Serialize()),
+		Relays:     []string{blocking.url},
+	})
+	assert.NilError(t, err)
+	defer blockingOnly.Close()
+	err = blockingOnly.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: receiver})
+	var nostrErr *NostrError
+	assert.Assert(t, errors.As(err, &nostrErr))
+	assert.Equal(t, nostrErr.Relays[blocking.url], "blocked: not allowed")
+	assert.Assert(t, notify.IsPermanent(err))
+
+	// A relay that is down is retried.
+	down, err := NewNostr(builder, NostrConfig{
+		PrivateKey: hex.EncodeToString(senderKey.Serialize()),
+		Relays:     []string{blocking.url, "ws://127.0.0.1:1"},
+	})
+	assert.NilError(t, err)
+	defer down.Close()
+	err = down.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: receiver})
+	assert.Assert(t, errors.As(err, &nostrErr))
+	assert.Assert(t, notify.IsRetryable(err))
+
+	err = nostr.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "npub1"})
+	assert.ErrorIs(t, err, ErrInvalidPubkey)
+	assert.Assert(t, notify.IsInvalidToken(err))
+
+	assertUnrecognizedTemplate(t, nostr, receiver)
+}
@@ -0,0 +1,63 @@
+package services
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+// unknownTemplate is the template the test builders have no message for.
+const unknownTemplate = "unknown"
+
+// testBuilder returns a message builder building the messages with build,
+// and none for unknownTemplate.
+func testBuilder[M any](build func(req *notify.Notification) *M) func(req *notify.Notification) (*M, error) {
+	return func(req *notify.Notification) (*M, error) {
+		if req.Template == unknownTemplate {
+			return nil, nil
+		}
+		return build(req), nil
+	}
+}
+
+// assertUnrecognizedTemplate checks that the service refuses the
+// notifications its builder has no message for.
+func assertUnrecognizedTemplate(t *testing.T, service notify.Service, target string) {
+	t.Helper()
+	err := service.Send(context.Background(), &notify.Notification{Template: unknownTemplate, TargetIdentifier: target})
+	assert.ErrorIs(t, err, ErrUnrecognizedTemplate)
+}
+
+// testRequest is a request received by a test push server.
+type testRequest struct {
+	header http.Header
+	body   []byte
+}
+
+// newTestPushServer starts a push server answering the paths in statuses
+// with their status code, and recording the other requests before
+// answering them with accepted. The server is closed with the test.
+func newTestPushServer(t *testing.T, tls bool, accepted int, statuses map[string]int) (*httptest.Server, chan testRequest) {
+	requests := make(chan testRequest, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if status, ok := statuses[r.URL.Path]; ok {
+			w.WriteHeader(status)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		requests <- testRequest{header: r.Header, body: body}
+		w.WriteHeader(accepted)
+	})
+	server := httptest.NewServer(handler)
+	if tls {
+		server.Close()
+		server = httptest.NewTLSServer(handler)
+	}
+	t.Cleanup(server.Close)
+	return server, requests
+}
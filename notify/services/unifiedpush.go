@@ -0,0 +1,128 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/breez/notify/notify"
+)
+
+// unifiedPushMaxPayload is the largest message the distributors must
+// accept.
+const unifiedPushMaxPayload = 4096
+
+const defaultUnifiedPushTimeout = 30 * time.Second
+
+var ErrInvalidEndpoint = notify.Permanent(fmt.Errorf("%w: invalid unifiedpush endpoint", notify.ErrInvalidToken))
+
+// UnifiedPushError is an error returned by the push server of an endpoint.
+// Unregistered endpoints (404 and 410) match notify.ErrInvalidToken. The
+// push server being throttled (429) or down (5xx) is retried, the other
+// statuses are a rejected message and permanent.
+type UnifiedPushError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *UnifiedPushError) Error() string {
+	return fmt.Sprintf("failed to send unifiedpush message %v %v", e.StatusCode, e.Body)
+}
+
+func (e *UnifiedPushError) Is(target error) bool {
+	return target == notify.ErrInvalidToken &&
+		(e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone)
+}
+
+// UnifiedPushMessage is a message to a single endpoint.
+type UnifiedPushMessage struct {
+	// Payload is delivered as is to the app, at most 4096 bytes.
+	Payload []byte
+	// TTL and Urgency are sent as the Web Push headers, honoured by the
+	// push servers that implement them.
+	TTL     time.Duration
+	Urgency string
+}
+
+type UnifiedPushMessageBuilder func(req *notify.Notification) (*UnifiedPushMessage, error)
+
+// UnifiedPushConfig configures the UnifiedPush service.
+type UnifiedPushConfig struct {
+	// Hosts are the push servers the endpoints may point to,
+	// "*.example.com" matching the subdomains.
+	Hosts []string
+	// Client defaults to a client that only connects to public addresses.
+	Client *http.Client
+}
+
+// UnifiedPush sends the notifications to the UnifiedPush endpoints of the
+// apps, which are the target identifiers. The push server of the endpoint
+// hands the message to the distributor app on the device. The endpoints
+// come from the callers, so they are only sent to when they are on one of
+// the configured push servers.
+type UnifiedPush struct {
+	messageBuilder UnifiedPushMessageBuilder
+	config         UnifiedPushConfig
+}
+
+func NewUnifiedPush(messageBuilder UnifiedPushMessageBuilder, config UnifiedPushConfig) (*UnifiedPush, error) {
+	if len(config.Hosts) == 0 {
+		return nil, errors.New("no unifiedpush hosts configured")
+	}
+	if config.Client == nil {
+		config.Client = newPublicClient(defaultUnifiedPushTimeout)
+	}
+	return &UnifiedPush{messageBuilder: messageBuilder, config: config}, nil
+}
+
+func (u *UnifiedPush) Send(ctx context.Context, req *notify.Notification) error {
+	endpoint, err := url.Parse(req.TargetIdentifier)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" ||
+		!allowedHost(endpoint.Hostname(), u.config.Hosts) {
+		return ErrInvalidEndpoint
+	}
+	message, err := u.messageBuilder(req)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if message == nil {
+		return ErrUnrecognizedTemplate
+	}
+	if len(message.Payload) > unifiedPushMaxPayload {
+		return notify.Permanent(fmt.Errorf("unifiedpush payload of %v bytes is too large", len(message.Payload)))
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(message.Payload))
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create unifiedpush request %v", err))
+	}
+	if message.TTL > 0 {
+		request.Header.Set("TTL", strconv.Itoa(int(message.TTL.Seconds())))
+	}
+	if message.Urgency != "" {
+		request.Header.Set("Urgency", message.Urgency)
+	}
+
+	res, err := u.config.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send unifiedpush message %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		notify.Logger(ctx).Debug("sent unifiedpush message", "status", res.StatusCode)
+		return nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	unifiedPushErr := &UnifiedPushError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		return unifiedPushErr
+	}
+	return notify.Permanent(unifiedPushErr)
+}
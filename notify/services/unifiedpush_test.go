@@ -0,0 +1,54 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+func TestUnifiedPush(t *testing.T) {
+	server, requests := newTestPushServer(t, true, http.StatusCreated, map[string]int{
+		"/gone":        http.StatusGone,
+		"/unavailable": http.StatusServiceUnavailable,
+	})
+	endpoint, _ := url.Parse(server.URL)
+	unifiedPush, err := NewUnifiedPush(testBuilder(func(*notify.Notification) *UnifiedPushMessage {
+		return &UnifiedPushMessage{Payload: []byte(`{"notification_type":"t1"}`), TTL: time.Minute, Urgency: "high"}
+	}), UnifiedPushConfig{Hosts: []string{endpoint.Hostname()}, Client: server.Client()})
+	assert.NilError(t, err)
+
+	err = unifiedPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: server.URL + "/up/1"})
+	assert.NilError(t, err)
+	r := <-requests
+	assert.Equal(t, string(r.body), `{"notification_type":"t1"}`)
+	assert.Equal(t, r.header.Get("TTL"), "60")
+	assert.Equal(t, r.header.Get("Urgency"), "high")
+
+	err = unifiedPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: server.URL + "/gone"})
+	var unifiedPushErr *UnifiedPushError
+	assert.Assert(t, errors.As(err, &unifiedPushErr))
+	assert.Equal(t, unifiedPushErr.StatusCode, http.StatusGone)
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = unifiedPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: server.URL + "/unavailable"})
+	assert.Assert(t, errors.As(err, &unifiedPushErr))
+	assert.Assert(t, notify.IsRetryable(err))
+
+	// Only the https endpoints of the configured push servers are sent to.
+	for _, target := range []string{"token1", "http://" + endpoint.Host + "/up/1", "https://", "https://ntfy.example.com/up/1"} {
+		err = unifiedPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: target})
+		assert.ErrorIs(t, err, ErrInvalidEndpoint)
+	}
+
+	assertUnrecognizedTemplate(t, unifiedPush, server.URL)
+
+	_, err = NewUnifiedPush(testBuilder(func(*notify.Notification) *UnifiedPushMessage { return nil }), UnifiedPushConfig{})
+	assert.ErrorContains(t, err, "no unifiedpush hosts")
+}
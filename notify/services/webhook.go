@@ -0,0 +1,181 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/breez/notify/notify"
+)
+
+// The headers of the webhook requests.
+const (
+	WebhookSignatureHeader  = "X-Notify-Signature"
+	WebhookTimestampHeader  = "X-Notify-Timestamp"
+	WebhookDeliveryIDHeader = "X-Notify-Delivery-Id"
+	WebhookAttemptHeader    = "X-Notify-Attempt"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+var ErrUnknownWebhookTarget = notify.Permanent(fmt.Errorf("%w: unknown webhook target", notify.ErrInvalidToken))
+
+// WebhookError is an error response of a webhook. A 410 Gone matches
+// notify.ErrInvalidToken. Timeouts (408), 425, throttling (429) and the
+// server errors (5xx) are retried, the other statuses are a rejected
+// notification and permanent.
+type WebhookError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WebhookError) Error() string {
+	return fmt.Sprintf("failed to call webhook %v %v", e.StatusCode, e.Body)
+}
+
+func (e *WebhookError) Is(target error) bool {
+	return target == notify.ErrInvalidToken && e.StatusCode == http.StatusGone
+}
+
+// WebhookEnvelope is the JSON body of the webhook requests.
+type WebhookEnvelope struct {
+	DeliveryID     string                 `json:"delivery_id"`
+	Template       string                 `json:"template"`
+	DisplayMessage string                 `json:"display_message,omitempty"`
+	AppData        *string                `json:"app_data,omitempty"`
+	Data           map[string]interface{} `json:"data,omitempty"`
+	Timestamp      int64                  `json:"timestamp"`
+}
+
+// WebhookTarget is a receiver of the webhooks, registered with the
+// service.
+type WebhookTarget struct {
+	URL string `json:"url"`
+	// Secret is the key of the HMAC-SHA256 signatures of its requests.
+	Secret string `json:"secret"`
+}
+
+// WebhookConfig configures the Webhook service.
+type WebhookConfig struct {
+	// Targets are the receivers by their id, the target identifier of
+	// their notifications.
+	Targets map[string]WebhookTarget
+	// Timeout bounds every request. Defaults to 10 seconds.
+	Timeout time.Duration
+	// PublicOnly only connects to the targets on public addresses, for the
+	// deployments whose targets are registered by third parties.
+	PublicOnly bool
+	// Client defaults to a plain client with Timeout, or to a client that
+	// only connects to public addresses when PublicOnly is set.
+	Client *http.Client
+}
+
+// Webhook POSTs the notifications to the url of their target, for the
+// integrators that receive them over HTTP rather than push. The targets are
+// registered with the service, each with its own secret, and the target
+// identifier is their id, so the callers can't pick the urls.
+//
+// The signature header is "sha256=" followed by the hex HMAC-SHA256 of the
+// timestamp header, a dot and the body. The receivers should check it and
+// reject old timestamps, and use the delivery id, which is the same for all
+// the attempts, to ignore the duplicates.
+type Webhook struct {
+	config WebhookConfig
+}
+
+func NewWebhook(config WebhookConfig) (*Webhook, error) {
+	for id, target := range config.Targets {
+		u, err := url.Parse(target.URL)
+		if err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return nil, fmt.Errorf("invalid url of webhook target %v", id)
+		}
+		if target.Secret == "" {
+			return nil, fmt.Errorf("no secret for webhook target %v", id)
+		}
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+	if config.Client == nil && config.PublicOnly {
+		config.Client = newPublicClient(config.Timeout)
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: config.Timeout}
+	}
+	return &Webhook{config: config}, nil
+}
+
+func (w *Webhook) Send(ctx context.Context, req *notify.Notification) error {
+	target, ok := w.config.Targets[req.TargetIdentifier]
+	if !ok {
+		return ErrUnknownWebhookTarget
+	}
+	now := time.Now()
+	body, err := json.Marshal(&WebhookEnvelope{
+		DeliveryID:     notify.DeliveryID(ctx),
+		Template:       req.Template,
+		DisplayMessage: req.DisplayMessage,
+		AppData:        req.AppData,
+		Data:           req.Data,
+		Timestamp:      now.Unix(),
+	})
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to marshal webhook body %v", err))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.config.Timeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create webhook request %v", err))
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookTimestampHeader, timestamp)
+	request.Header.Set(WebhookSignatureHeader, SignWebhook([]byte(target.Secret), timestamp, body))
+	if deliveryID := notify.DeliveryID(ctx); deliveryID != "" {
+		request.Header.Set(WebhookDeliveryIDHeader, deliveryID)
+	}
+	if attempt := notify.Attempt(ctx); attempt > 0 {
+		request.Header.Set(WebhookAttemptHeader, strconv.Itoa(attempt))
+	}
+
+	res, err := w.config.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to call webhook %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	webhookErr := &WebhookError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	switch {
+	case res.StatusCode == http.StatusRequestTimeout,
+		res.StatusCode == http.StatusTooEarly,
+		res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= http.StatusInternalServerError:
+		return webhookErr
+	default:
+		return notify.Permanent(webhookErr)
+	}
+}
+
+// SignWebhook returns the signature header of a webhook body.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
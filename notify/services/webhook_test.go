@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	server, requests := newTestPushServer(t, false, http.StatusNoContent, map[string]int{
+		"/gone": http.StatusGone,
+		"/busy": http.StatusTooManyRequests,
+		"/bad":  http.StatusBadRequest,
+	})
+	webhook, err := NewWebhook(WebhookConfig{
+		Targets: map[string]WebhookTarget{
+			"lsp1": {URL: server.URL + "/hook", Secret: "secret1"},
+			"lsp2": {URL: server.URL + "/hook", Secret: "secret2"},
+			"gone": {URL: server.URL + "/gone", Secret: "secret"},
+			"busy": {URL: server.URL + "/busy", Secret: "secret"},
+			"bad":  {URL: server.URL + "/bad", Secret: "secret"},
+		},
+		Client: server.Client(),
+	})
+	assert.NilError(t, err)
+	notifier := notify.NewNotifier(&config.Config{WorkersNum: 1}, map[string]notify.Service{"webhook": webhook})
+	appData := "app"
+	id, err := notifier.Notify(context.Background(), &notify.Notification{
+		Template:         "t1",
+		Type:             "webhook",
+		TargetIdentifier: "lsp1",
+		AppData:          &appData,
+		Data:             map[string]interface{}{"amount": 1000},
+	})
+	assert.NilError(t, err)
+	r := <-requests
+	assert.Equal(t, r.header.Get(WebhookDeliveryIDHeader), id)
+	assert.Equal(t, r.header.Get(WebhookAttemptHeader), "1")
+	assert.Equal(t, r.header.Get(WebhookSignatureHeader), SignWebhook([]byte("secret1"), r.header.Get(WebhookTimestampHeader), r.body))
+	var envelope WebhookEnvelope
+	assert.NilError(t, json.Unmarshal(r.body, &envelope))
+	assert.Equal(t, envelope.DeliveryID, id)
+	assert.Equal(t, envelope.Template, "t1")
+	assert.Equal(t, *envelope.AppData, "app")
+	assert.DeepEqual(t, envelope.Data, map[string]interface{}{"amount": float64(1000)})
+
+	// Every target is signed with its own secret.
+	err = webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "lsp2"})
+	assert.NilError(t, err)
+	r = <-requests
+	assert.Equal(t, r.header.Get(WebhookSignatureHeader), SignWebhook([]byte("secret2"), r.header.Get(WebhookTimestampHeader), r.body))
+
+	err = webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "gone"})
+	var webhookErr *WebhookError
+	assert.Assert(t, errors.As(err, &webhookErr))
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "busy"})
+	assert.Assert(t, errors.As(err, &webhookErr))
+	assert.Assert(t, notify.IsRetryable(err))
+
+	err = webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "bad"})
+	assert.Assert(t, errors.As(err, &webhookErr))
+	assert.Assert(t, notify.IsPermanent(err))
+	assert.Assert(t, !notify.IsInvalidToken(err))
+
+	// The target identifier is the id of a registered target, never a url.
+	for _, target := range []string{"unknown", server.URL + "/hook"} {
+		err = webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: target})
+		assert.ErrorIs(t, err, ErrUnknownWebhookTarget)
+	}
+
+	_, err = NewWebhook(WebhookConfig{Targets: map[string]WebhookTarget{"lsp1": {URL: "ftp://example.com", Secret: "secret"}}})
+	assert.ErrorContains(t, err, "invalid url")
+	_, err = NewWebhook(WebhookConfig{Targets: map[string]WebhookTarget{"lsp1": {URL: "https://example.com"}}})
+	assert.ErrorContains(t, err, "no secret")
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	server, requests := newTestPushServer(t, false, http.StatusNoContent, nil)
+	targets := map[string]WebhookTarget{"lsp1": {URL: server.URL, Secret: "secret"}}
+
+	// The registered targets are trusted by default, wherever they are.
+	webhook, err := NewWebhook(WebhookConfig{Targets: targets})
+	assert.NilError(t, err)
+	assert.NilError(t, webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "lsp1"}))
+	<-requests
+
+	webhook, err = NewWebhook(WebhookConfig{Targets: targets, PublicOnly: true})
+	assert.NilError(t, err)
+	err = webhook.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: "lsp1"})
+	assert.ErrorIs(t, err, ErrPrivateAddress)
+	assert.Assert(t, notify.IsPermanent(err))
+}
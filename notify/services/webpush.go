@@ -0,0 +1,346 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// webPushRecordSize is the record size of the aes128gcm encoding. The
+	// payload is sent in a single record.
+	webPushRecordSize = 4096
+	// webPushMaxPayload is the largest payload push services must accept.
+	webPushMaxPayload = 3993
+	// vapidTokenLifetime is the validity of the VAPID tokens, push services
+	// reject tokens valid for more than 24 hours.
+	vapidTokenLifetime = 12 * time.Hour
+
+	defaultWebPushTTL     = 24 * time.Hour
+	defaultWebPushTimeout = 30 * time.Second
+)
+
+// The Web Push urgencies.
+const (
+	WebPushUrgencyVeryLow = "very-low"
+	WebPushUrgencyLow     = "low"
+	WebPushUrgencyNormal  = "normal"
+	WebPushUrgencyHigh    = "high"
+)
+
+var ErrInvalidSubscription = notify.Permanent(fmt.Errorf("%w: invalid web push subscription", notify.ErrInvalidToken))
+
+// WebPushHosts are the push services of the browsers: FCM for Chrome, the
+// Mozilla push service, Apple's for Safari and WNS for Edge.
+var WebPushHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"*.push.apple.com",
+	"*.notify.windows.com",
+}
+
+// WebPushSubscription is the PushSubscription of the browser, serialized
+// with toJSON(). It is the target identifier of the web notifications.
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// ParseWebPushSubscription parses and validates the JSON subscription.
+func ParseWebPushSubscription(target string) (*WebPushSubscription, error) {
+	var sub WebPushSubscription
+	if err := json.Unmarshal([]byte(target), &sub); err != nil {
+		return nil, ErrInvalidSubscription
+	}
+	endpoint, err := url.Parse(sub.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, ErrInvalidSubscription
+	}
+	if sub.Keys.P256dh == "" || sub.Keys.Auth == "" {
+		return nil, ErrInvalidSubscription
+	}
+	return &sub, nil
+}
+
+// WebPushError is an error returned by the push service of a subscription.
+// Expired subscriptions (404 and 410) match notify.ErrInvalidToken. The
+// push service being throttled (429) or down (5xx) is retried, the other
+// statuses are a rejected message and permanent.
+type WebPushError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *WebPushError) Error() string {
+	return fmt.Sprintf("failed to send web push message %v %v", e.StatusCode, e.Body)
+}
+
+func (e *WebPushError) Is(target error) bool {
+	return target == notify.ErrInvalidToken &&
+		(e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusGone)
+}
+
+// WebPushMessage is a message to a single subscription.
+type WebPushMessage struct {
+	// Payload is encrypted for the subscription, at most 3993 bytes.
+	Payload []byte
+	// TTL is how long the push service keeps the message while the browser
+	// is offline. Defaults to 24 hours.
+	TTL time.Duration
+	// Urgency is one of the WebPushUrgency values.
+	Urgency string
+	// Topic replaces the pending message with the same topic.
+	Topic string
+}
+
+type WebPushMessageBuilder func(req *notify.Notification) (*WebPushMessage, error)
+
+// WebPushConfig configures the Web Push service.
+type WebPushConfig struct {
+	// VAPIDPrivateKey is the base64url encoded private key of the
+	// application server, as generated by the web push libraries.
+	VAPIDPrivateKey string
+	// Subject is a mailto: or https: contact.
+	Subject string
+	// Hosts are the push services the subscription endpoints may point to,
+	// "*.example.com" matching the subdomains. Defaults to WebPushHosts.
+	Hosts []string
+	// Client defaults to a client that only connects to public addresses.
+	Client *http.Client
+}
+
+// WebPush sends the notifications to the push services of the browsers,
+// authenticated with VAPID. The subscription endpoints come from the
+// callers, so they are only sent to when they are on one of the configured
+// push services.
+type WebPush struct {
+	messageBuilder WebPushMessageBuilder
+	key            *ecdsa.PrivateKey
+	publicKey      string
+	config         WebPushConfig
+}
+
+func NewWebPush(messageBuilder WebPushMessageBuilder, config WebPushConfig) (*WebPush, error) {
+	key, err := ParseVAPIDKey(config.VAPIDPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(config.Hosts) == 0 {
+		config.Hosts = WebPushHosts
+	}
+	if config.Client == nil {
+		config.Client = newPublicClient(defaultWebPushTimeout)
+	}
+	return &WebPush{
+		messageBuilder: messageBuilder,
+		key:            key,
+		publicKey:      base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), key.X, key.Y)),
+		config:         config,
+	}, nil
+}
+
+// ParseVAPIDKey parses a base64url encoded P-256 private key.
+func ParseVAPIDKey(vapidPrivateKey string) (*ecdsa.PrivateKey, error) {
+	d, err := decodeBase64(vapidPrivateKey)
+	if err != nil || len(d) != 32 {
+		return nil, errors.New("invalid vapid private key")
+	}
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(d)
+	return key, nil
+}
+
+// PublicKey returns the base64url encoded VAPID public key, the
+// applicationServerKey the browsers subscribe with.
+func (w *WebPush) PublicKey() string {
+	return w.publicKey
+}
+
+func (w *WebPush) Send(ctx context.Context, req *notify.Notification) error {
+	sub, err := ParseWebPushSubscription(req.TargetIdentifier)
+	if err != nil {
+		return err
+	}
+	if endpoint, _ := url.Parse(sub.Endpoint); !allowedHost(endpoint.Hostname(), w.config.Hosts) {
+		return ErrInvalidSubscription
+	}
+	message, err := w.messageBuilder(req)
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create message %v", err))
+	}
+	if message == nil {
+		return ErrUnrecognizedTemplate
+	}
+	if len(message.Payload) > webPushMaxPayload {
+		return notify.Permanent(fmt.Errorf("web push payload of %v bytes is too large", len(message.Payload)))
+	}
+	body, err := encryptWebPush(sub, message.Payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := w.vapid(sub.Endpoint)
+	if err != nil {
+		return notify.Permanent(err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return notify.Permanent(fmt.Errorf("failed to create web push request %v", err))
+	}
+	ttl := message.TTL
+	if ttl == 0 {
+		ttl = defaultWebPushTTL
+	}
+	request.Header.Set("Authorization", authorization)
+	request.Header.Set("Content-Encoding", "aes128gcm")
+	request.Header.Set("Content-Type", "application/octet-stream")
+	request.Header.Set("TTL", strconv.Itoa(int(ttl.Seconds())))
+	if message.Urgency != "" {
+		request.Header.Set("Urgency", message.Urgency)
+	}
+	if message.Topic != "" {
+		request.Header.Set("Topic", message.Topic)
+	}
+
+	res, err := w.config.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to send web push message %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		notify.Logger(ctx).Debug("sent web push message", "location", res.Header.Get("Location"))
+		return nil
+	}
+	data, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	webPushErr := &WebPushError{StatusCode: res.StatusCode, Body: strings.TrimSpace(string(data))}
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= http.StatusInternalServerError {
+		return webPushErr
+	}
+	return notify.Permanent(webPushErr)
+}
+
+// vapid returns the Authorization header of RFC 8292 for the push service
+// of the endpoint.
+func (w *WebPush) vapid(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	token, err := signES256(w.key,
+		map[string]string{"typ": "JWT", "alg": "ES256"},
+		map[string]interface{}{
+			"aud": u.Scheme + "://" + u.Host,
+			"exp": time.Now().Add(vapidTokenLifetime).Unix(),
+			"sub": w.config.Subject,
+		})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign vapid token %w", err)
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", token, w.publicKey), nil
+}
+
+// encryptWebPush encrypts the payload for the subscription with the
+// aes128gcm content encoding of RFC 8291, in a single record.
+func encryptWebPush(sub *WebPushSubscription, payload []byte) ([]byte, error) {
+	curve := elliptic.P256()
+	uaPublic, err := decodeBase64(sub.Keys.P256dh)
+	if err != nil {
+		return nil, ErrInvalidSubscription
+	}
+	uaX, uaY := elliptic.Unmarshal(curve, uaPublic)
+	if uaX == nil {
+		return nil, ErrInvalidSubscription
+	}
+	authSecret, err := decodeBase64(sub.Keys.Auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, ErrInvalidSubscription
+	}
+
+	asPrivate, asX, asY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := elliptic.Marshal(curve, asX, asY)
+	sharedX, _ := curve.ScalarMult(uaX, uaY, asPrivate)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm, err := hkdfExpand(hkdf.Extract(sha256.New, ecdhSecret, authSecret), keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek, err := hkdfExpand(prk, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdfExpand(prk, []byte("Content-Encoding: nonce\x00"), 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// The header is the salt, the record size and the public key of the
+	// application server, followed by the single record ending with the
+	// last record delimiter.
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	record := append(append([]byte{}, payload...), 0x02)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+func hkdfExpand(prk, info []byte, length int) ([]byte, error) {
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, info), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decodeBase64 decodes the base64url keys, padded or not, and tolerates the
+// standard encoding some clients use.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.TrimRight(s, "=")
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(s)
+	return base64.RawURLEncoding.DecodeString(s)
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"golang.org/x/crypto/hkdf"
+	"gotest.tools/v3/assert"
+)
+
+// testBrowser is the user agent side of a subscription.
+type testBrowser struct {
+	private    []byte
+	public     []byte
+	authSecret []byte
+}
+
+func newTestBrowser(t *testing.T) *testBrowser {
+	private, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	return &testBrowser{private: private, public: elliptic.Marshal(elliptic.P256(), x, y), authSecret: authSecret}
+}
+
+func (b *testBrowser) subscription(endpoint string) string {
+	sub := WebPushSubscription{Endpoint: endpoint}
+	sub.Keys.P256dh = base64.RawURLEncoding.EncodeToString(b.public)
+	sub.Keys.Auth = base64.RawURLEncoding.EncodeToString(b.authSecret)
+	data, _ := json.Marshal(sub)
+	return string(data)
+}
+
+// decrypt decrypts an aes128gcm body as in RFC 8291.
+func (b *testBrowser) decrypt(t *testing.T, body []byte) []byte {
+	salt := body[:16]
+	assert.Equal(t, binary.BigEndian.Uint32(body[16:20]), uint32(webPushRecordSize))
+	idLen := int(body[20])
+	asPublic := body[21 : 21+idLen]
+	record := body[21+idLen:]
+
+	curve := elliptic.P256()
+	x, y := elliptic.Unmarshal(curve, asPublic)
+	sharedX, _ := curve.ScalarMult(x, y, b.private)
+	ecdhSecret := make([]byte, 32)
+	sharedX.FillBytes(ecdhSecret)
+	keyInfo := append(append([]byte("WebPush: info\x00"), b.public...), asPublic...)
+	ikm := make([]byte, 32)
+	io.ReadFull(hkdf.New(sha256.New, ecdhSecret, b.authSecret, keyInfo), ikm)
+	cek := make([]byte, 16)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), cek)
+	nonce := make([]byte, 12)
+	io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce)
+
+	block, err := aes.NewCipher(cek)
+	assert.NilError(t, err)
+	gcm, err := cipher.NewGCM(block)
+	assert.NilError(t, err)
+	plain, err := gcm.Open(nil, nonce, record, nil)
+	assert.NilError(t, err)
+	assert.Equal(t, plain[len(plain)-1], byte(0x02))
+	return plain[:len(plain)-1]
+}
+
+func TestWebPush(t *testing.T) {
+	vapidKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	d := make([]byte, 32)
+	vapidKey.D.FillBytes(d)
+
+	server, requests := newTestPushServer(t, true, http.StatusCreated, map[string]int{
+		"/expired": http.StatusGone,
+		"/busy":    http.StatusTooManyRequests,
+	})
+	endpoint, _ := url.Parse(server.URL)
+	webPush, err := NewWebPush(testBuilder(func(*notify.Notification) *WebPushMessage {
+		return &WebPushMessage{Payload: []byte(`{"title":"hello"}`), TTL: time.Hour, Urgency: WebPushUrgencyHigh, Topic: "t1"}
+	}), WebPushConfig{
+		VAPIDPrivateKey: base64.RawURLEncoding.EncodeToString(d),
+		Subject:         "mailto:dev@breez.technology",
+		Hosts:           []string{endpoint.Hostname()},
+		Client:          server.Client(),
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, webPush.PublicKey(), base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), vapidKey.X, vapidKey.Y)))
+
+	browser := newTestBrowser(t)
+	err = webPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: browser.subscription(server.URL + "/push/1")})
+	assert.NilError(t, err)
+	r := <-requests
+	assert.Equal(t, r.header.Get("Content-Encoding"), "aes128gcm")
+	assert.Equal(t, r.header.Get("TTL"), "3600")
+	assert.Equal(t, r.header.Get("Urgency"), "high")
+	assert.Equal(t, r.header.Get("Topic"), "t1")
+	assert.Equal(t, string(browser.decrypt(t, r.body)), `{"title":"hello"}`)
+
+	// The VAPID token is signed for the origin of the push service.
+	var token, k string
+	for _, part := range strings.Split(strings.TrimPrefix(r.header.Get("Authorization"), "vapid "), ", ") {
+		if strings.HasPrefix(part, "t=") {
+			token = strings.TrimPrefix(part, "t=")
+		} else if strings.HasPrefix(part, "k=") {
+			k = strings.TrimPrefix(part, "k=")
+		}
+	}
+	assert.Equal(t, k, webPush.PublicKey())
+	assert.Assert(t, verifyES256(token, &vapidKey.PublicKey))
+	claims, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	assert.NilError(t, err)
+	var vapid map[string]interface{}
+	assert.NilError(t, json.Unmarshal(claims, &vapid))
+	assert.Equal(t, vapid["aud"], server.URL)
+	assert.Equal(t, vapid["sub"], "mailto:dev@breez.technology")
+
+	err = webPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: browser.subscription(server.URL + "/expired")})
+	var webPushErr *WebPushError
+	assert.Assert(t, errors.As(err, &webPushErr))
+	assert.Equal(t, webPushErr.StatusCode, http.StatusGone)
+	assert.Assert(t, notify.IsInvalidToken(err))
+	assert.Assert(t, notify.IsPermanent(err))
+
+	err = webPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: browser.subscription(server.URL + "/busy")})
+	assert.Assert(t, errors.As(err, &webPushErr))
+	assert.Assert(t, notify.IsRetryable(err))
+
+	// Only the https endpoints of the configured push services are sent to.
+	for _, target := range []string{
+		"not a subscription",
+		browser.subscription("http://" + endpoint.Host + "/push/1"),
+		browser.subscription("https://internal.example.com/push/1"),
+	} {
+		err = webPush.Send(context.Background(), &notify.Notification{Template: "t1", TargetIdentifier: target})
+		assert.ErrorIs(t, err, ErrInvalidSubscription)
+		assert.Assert(t, notify.IsInvalidToken(err))
+	}
+
+	assertUnrecognizedTemplate(t, webPush, browser.subscription(server.URL))
+}
@@ -0,0 +1,282 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// deliveryRetention is how long the status of a delivery is kept.
+	deliveryRetention = 24 * time.Hour
+	pruneInterval     = time.Minute
+)
+
+var (
+	pendingBucket     = []byte("pending")
+	deadLettersBucket = []byte("dead_letters")
+	deliveriesBucket  = []byte("deliveries")
+	scheduledBucket   = []byte("scheduled")
+	blockedBucket     = []byte("blocked_tokens")
+)
+
+// blockedToken is the value of a token in the blocked tokens bucket.
+type blockedToken struct {
+	Reason    string    `json:"reason"`
+	BlockedAt time.Time `json:"blocked_at"`
+}
+
+// BoltStore is a notify.Store backed by an embedded bbolt database file. It
+// also keeps the dead letters, the deliveries, the scheduled notifications
+// and the blocked tokens.
+type BoltStore struct {
+	db *bolt.DB
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open store %v: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{pendingBucket, deadLettersBucket, deliveriesBucket, scheduledBucket, blockedBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltStore) Save(id string, notification *notify.Notification) error {
+	value, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).Put([]byte(id), value)
+	})
+}
+
+func (s *BoltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Pending() ([]*notify.PendingNotification, error) {
+	var pending []*notify.PendingNotification
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingBucket).ForEach(func(k, v []byte) error {
+			var notification notify.Notification
+			if err := json.Unmarshal(v, &notification); err != nil {
+				return fmt.Errorf("failed to unmarshal notification %s: %w", k, err)
+			}
+			pending = append(pending, &notify.PendingNotification{
+				ID:           string(k),
+				Notification: &notification,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (s *BoltStore) AddDeadLetter(letter *notify.DeadLetter) error {
+	value, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Put([]byte(letter.ID), value)
+	})
+}
+
+func (s *BoltStore) DeadLetters() ([]*notify.DeadLetter, error) {
+	var letters []*notify.DeadLetter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).ForEach(func(k, v []byte) error {
+			var letter notify.DeadLetter
+			if err := json.Unmarshal(v, &letter); err != nil {
+				return fmt.Errorf("failed to unmarshal dead letter %s: %w", k, err)
+			}
+			letters = append(letters, &letter)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letters, nil
+}
+
+func (s *BoltStore) DeadLetter(id string) (*notify.DeadLetter, error) {
+	var letter *notify.DeadLetter
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deadLettersBucket).Get([]byte(id))
+		if v == nil {
+			return notify.ErrDeadLetterNotFound
+		}
+		letter = &notify.DeadLetter{}
+		return json.Unmarshal(v, letter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+func (s *BoltStore) RemoveDeadLetter(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) SaveDelivery(delivery *notify.Delivery) error {
+	value, err := json.Marshal(delivery)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery: %w", err)
+	}
+	prune := s.shouldPrune()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deliveriesBucket)
+		if prune {
+			// Ids start with their creation time so the expired deliveries
+			// are among the first keys of the bucket.
+			cutoff := time.Now().Add(-deliveryRetention)
+			prefix := []byte(notify.IDPrefix(cutoff))
+			var expired [][]byte
+			c := bucket.Cursor()
+			for k, v := c.First(); k != nil && bytes.Compare(k, prefix) < 0; k, v = c.Next() {
+				var d notify.Delivery
+				if err := json.Unmarshal(v, &d); err != nil || deliveryExpired(&d, cutoff) {
+					expired = append(expired, k)
+				}
+			}
+			for _, k := range expired {
+				if err := bucket.Delete(k); err != nil {
+					return err
+				}
+			}
+		}
+		return bucket.Put([]byte(delivery.ID), value)
+	})
+}
+
+func (s *BoltStore) Delivery(id string) (*notify.Delivery, error) {
+	var delivery *notify.Delivery
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deliveriesBucket).Get([]byte(id))
+		if v == nil {
+			return notify.ErrDeliveryNotFound
+		}
+		delivery = &notify.Delivery{}
+		return json.Unmarshal(v, delivery)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (s *BoltStore) SaveScheduled(scheduled *notify.ScheduledNotification) error {
+	value, err := json.Marshal(scheduled)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled notification: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledBucket).Put([]byte(scheduled.ID), value)
+	})
+}
+
+func (s *BoltStore) RemoveScheduled(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledBucket).Delete([]byte(id))
+	})
+}
+
+func (s *BoltStore) Scheduled() ([]*notify.ScheduledNotification, error) {
+	var scheduled []*notify.ScheduledNotification
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(scheduledBucket).ForEach(func(k, v []byte) error {
+			var notification notify.ScheduledNotification
+			if err := json.Unmarshal(v, &notification); err != nil {
+				return fmt.Errorf("failed to unmarshal scheduled notification %s: %w", k, err)
+			}
+			scheduled = append(scheduled, &notification)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scheduled, nil
+}
+
+// blockedTokenKey is the key of a token in the blocked tokens bucket, its
+// type and the token separated by a NUL.
+func blockedTokenKey(tokenType string, token string) []byte {
+	return []byte(tokenType + "\x00" + token)
+}
+
+func (s *BoltStore) BlockToken(tokenType string, token string, reason string) error {
+	value, err := json.Marshal(&blockedToken{Reason: reason, BlockedAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal blocked token: %w", err)
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blockedBucket).Put(blockedTokenKey(tokenType, token), value)
+	})
+}
+
+func (s *BoltStore) IsTokenBlocked(tokenType string, token string) (bool, error) {
+	var blocked bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		blocked = tx.Bucket(blockedBucket).Get(blockedTokenKey(tokenType, token)) != nil
+		return nil
+	})
+	return blocked, err
+}
+
+func (s *BoltStore) UnblockToken(tokenType string, token string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(blockedBucket).Delete(blockedTokenKey(tokenType, token))
+	})
+}
+
+// deliveryExpired reports whether the delivery was last updated before
+// cutoff. The scheduled ones are kept until they are sent, however far
+// ahead they are scheduled.
+func deliveryExpired(d *notify.Delivery, cutoff time.Time) bool {
+	return d.State != notify.DeliveryScheduled && d.UpdatedAt.Before(cutoff)
+}
+
+func (s *BoltStore) shouldPrune() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastPruned) < pruneInterval {
+		return false
+	}
+	s.lastPruned = time.Now()
+	return true
+}
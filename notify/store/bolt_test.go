@@ -0,0 +1,120 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"gotest.tools/v3/assert"
+)
+
+func TestBoltStorePending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.db")
+	s, err := NewBoltStore(path)
+	assert.NilError(t, err)
+
+	appData := "data"
+	n1 := &notify.Notification{Template: "t1", Type: "test", TargetIdentifier: "token1", AppData: &appData}
+	n2 := &notify.Notification{Template: "t2", Type: "test", TargetIdentifier: "token2", Data: map[string]interface{}{"tx_id": "1234"}}
+	assert.NilError(t, s.Save("1", n1))
+	assert.NilError(t, s.Save("2", n2))
+	assert.NilError(t, s.Save("3", n2))
+	assert.NilError(t, s.Delete("3"))
+	assert.NilError(t, s.Close())
+
+	// Reopen to make sure the notifications survived.
+	s, err = NewBoltStore(path)
+	assert.NilError(t, err)
+	defer s.Close()
+	pending, err := s.Pending()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, pending, []*notify.PendingNotification{
+		{ID: "1", Notification: n1},
+		{ID: "2", Notification: n2},
+	})
+}
+
+func TestBoltStoreDeadLetters(t *testing.T) {
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "notify.db"))
+	assert.NilError(t, err)
+	defer s.Close()
+
+	letter := &notify.DeadLetter{
+		ID:           "1",
+		Notification: &notify.Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"},
+		Attempts:     3,
+		LastError:    "unavailable",
+		FailedAt:     time.Unix(1700000000, 0).UTC(),
+	}
+	assert.NilError(t, s.AddDeadLetter(letter))
+	letters, err := s.DeadLetters()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, letters, []*notify.DeadLetter{letter})
+	got, err := s.DeadLetter("1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, letter)
+
+	assert.NilError(t, s.RemoveDeadLetter("1"))
+	_, err = s.DeadLetter("1")
+	assert.ErrorIs(t, err, notify.ErrDeadLetterNotFound)
+}
+
+func TestBoltStoreScheduled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.db")
+	s, err := NewBoltStore(path)
+	assert.NilError(t, err)
+
+	scheduled := &notify.ScheduledNotification{
+		ID:           "1",
+		Notification: &notify.Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"},
+		SendAt:       time.Unix(1700000000, 0).UTC(),
+	}
+	assert.NilError(t, s.SaveScheduled(scheduled))
+	assert.NilError(t, s.SaveScheduled(&notify.ScheduledNotification{ID: "2", Notification: scheduled.Notification}))
+	assert.NilError(t, s.RemoveScheduled("2"))
+	assert.NilError(t, s.Close())
+
+	s, err = NewBoltStore(path)
+	assert.NilError(t, err)
+	defer s.Close()
+	got, err := s.Scheduled()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, got, []*notify.ScheduledNotification{scheduled})
+}
+
+func TestDeliveryPruning(t *testing.T) {
+	bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "notify.db"))
+	assert.NilError(t, err)
+	defer bolt.Close()
+	memory := NewMemoryStore()
+	stores := map[string]struct {
+		notify.DeliveryStore
+		resetPruning func()
+	}{
+		"bolt":   {bolt, func() { bolt.lastPruned = time.Time{} }},
+		"memory": {memory, func() { memory.lastPruned = time.Time{} }},
+	}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			created := notify.IDPrefix(time.Now().Add(-48 * time.Hour))
+			// Scheduled more than the retention ahead, created 48h ago.
+			scheduled := &notify.Delivery{ID: created + "1", State: notify.DeliveryScheduled, UpdatedAt: time.Now().Add(-48 * time.Hour)}
+			sent := &notify.Delivery{ID: created + "2", State: notify.DeliverySent, UpdatedAt: time.Now().Add(-48 * time.Hour)}
+			// Sent just now, after waiting for its schedule.
+			fired := &notify.Delivery{ID: created + "3", State: notify.DeliverySent, UpdatedAt: time.Now()}
+			for _, d := range []*notify.Delivery{scheduled, sent, fired} {
+				assert.NilError(t, s.SaveDelivery(d))
+			}
+			s.resetPruning()
+			assert.NilError(t, s.SaveDelivery(&notify.Delivery{ID: notify.IDPrefix(time.Now()) + "4", State: notify.DeliveryQueued, UpdatedAt: time.Now()}))
+
+			_, err := s.Delivery(scheduled.ID)
+			assert.NilError(t, err)
+			_, err = s.Delivery(fired.ID)
+			assert.NilError(t, err)
+			_, err = s.Delivery(sent.ID)
+			assert.ErrorIs(t, err, notify.ErrDeliveryNotFound)
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+)
+
+// MemoryStore keeps dead letters, deliveries and blocked tokens in memory. Its content is
+// lost on restart.
+type MemoryStore struct {
+	sync.Mutex
+	deadLetters map[string]*notify.DeadLetter
+	deliveries  map[string]*notify.Delivery
+	blocked     map[blockedKey]string
+	lastPruned  time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		deadLetters: make(map[string]*notify.DeadLetter),
+		deliveries:  make(map[string]*notify.Delivery),
+		blocked:     make(map[blockedKey]string),
+	}
+}
+
+func (s *MemoryStore) AddDeadLetter(letter *notify.DeadLetter) error {
+	s.Lock()
+	defer s.Unlock()
+	s.deadLetters[letter.ID] = letter
+	return nil
+}
+
+func (s *MemoryStore) DeadLetters() ([]*notify.DeadLetter, error) {
+	s.Lock()
+	defer s.Unlock()
+	letters := make([]*notify.DeadLetter, 0, len(s.deadLetters))
+	for _, letter := range s.deadLetters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+	return letters, nil
+}
+
+func (s *MemoryStore) DeadLetter(id string) (*notify.DeadLetter, error) {
+	s.Lock()
+	defer s.Unlock()
+	letter, ok := s.deadLetters[id]
+	if !ok {
+		return nil, notify.ErrDeadLetterNotFound
+	}
+	return letter, nil
+}
+
+func (s *MemoryStore) RemoveDeadLetter(id string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.deadLetters, id)
+	return nil
+}
+
+func (s *MemoryStore) SaveDelivery(delivery *notify.Delivery) error {
+	s.Lock()
+	defer s.Unlock()
+	s.deliveries[delivery.ID] = delivery
+	if time.Since(s.lastPruned) > pruneInterval {
+		s.lastPruned = time.Now()
+		cutoff := time.Now().Add(-deliveryRetention)
+		prefix := notify.IDPrefix(cutoff)
+		for id, d := range s.deliveries {
+			if id < prefix && deliveryExpired(d, cutoff) {
+				delete(s.deliveries, id)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) Delivery(id string) (*notify.Delivery, error) {
+	s.Lock()
+	defer s.Unlock()
+	delivery, ok := s.deliveries[id]
+	if !ok {
+		return nil, notify.ErrDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+// blockedKey is the key of a token in the blocked tokens.
+type blockedKey struct {
+	tokenType string
+	token     string
+}
+
+func (s *MemoryStore) BlockToken(tokenType string, token string, reason string) error {
+	s.Lock()
+	defer s.Unlock()
+	s.blocked[blockedKey{tokenType, token}] = reason
+	return nil
+}
+
+func (s *MemoryStore) IsTokenBlocked(tokenType string, token string) (bool, error) {
+	s.Lock()
+	defer s.Unlock()
+	_, ok := s.blocked[blockedKey{tokenType, token}]
+	return ok, nil
+}
+
+func (s *MemoryStore) UnblockToken(tokenType string, token string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.blocked, blockedKey{tokenType, token})
+	return nil
+}
@@ -0,0 +1,192 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is wrapped by the errors of services for targets that
+	// will never accept a notification again, like an unregistered FCM token.
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenBlocked is returned for targets in the token blocklist.
+	ErrTokenBlocked = Permanent(fmt.Errorf("%w: token is blocked", ErrInvalidToken))
+
+	ErrTokenBlocklistNotEnabled = errors.New("token blocklist is not configured")
+)
+
+// IsInvalidToken reports whether err is caused by an invalid target.
+func IsInvalidToken(err error) bool {
+	return errors.Is(err, ErrInvalidToken)
+}
+
+// TokenBlocklist keeps the tokens that were reported invalid, so the
+// notifications to them are not sent anymore. The tokens are blocked for
+// the notification type they were rejected for only, as the same string can
+// be the token of another type.
+type TokenBlocklist interface {
+	BlockToken(tokenType string, token string, reason string) error
+	IsTokenBlocked(tokenType string, token string) (bool, error)
+	UnblockToken(tokenType string, token string) error
+}
+
+// InvalidToken describes a token a service reported invalid.
+type InvalidToken struct {
+	Type             string    `json:"type"`
+	TargetIdentifier string    `json:"target_identifier"`
+	Template         string    `json:"template"`
+	Reason           string    `json:"reason"`
+	InvalidatedAt    time.Time `json:"invalidated_at"`
+}
+
+// TokenInvalidatedHandler is called when a service reports a token invalid.
+// It runs on the worker of the notification so it should not block.
+type TokenInvalidatedHandler func(ctx context.Context, token *InvalidToken)
+
+// WithTokenBlocklist blocks the tokens services report invalid. Notify
+// rejects the notifications to blocked tokens with ErrTokenBlocked.
+func WithTokenBlocklist(blocklist TokenBlocklist) Option {
+	return func(n *Notifier) {
+		n.blocklist = blocklist
+	}
+}
+
+// WithTokenInvalidatedHandler adds a handler called when a service reports a
+// token invalid.
+func WithTokenInvalidatedHandler(handler TokenInvalidatedHandler) Option {
+	return func(n *Notifier) {
+		n.tokenHandlers = append(n.tokenHandlers, handler)
+	}
+}
+
+// IsTokenBlocked reports whether the token of the notification type is in
+// the token blocklist.
+func (n *Notifier) IsTokenBlocked(tokenType string, token string) bool {
+	if n.blocklist == nil {
+		return false
+	}
+	blocked, err := n.blocklist.IsTokenBlocked(tokenType, token)
+	if err != nil {
+		n.logger.Error("failed to check token blocklist", "error", err)
+		return false
+	}
+	return blocked
+}
+
+// UnblockToken removes the token of the notification type from the token
+// blocklist.
+func (n *Notifier) UnblockToken(tokenType string, token string) error {
+	if n.blocklist == nil {
+		return ErrTokenBlocklistNotEnabled
+	}
+	return n.blocklist.UnblockToken(tokenType, token)
+}
+
+// unblocked returns the notification without its blocked targets, or nil
+// when all of them are blocked.
+func (n *Notifier) unblocked(request *Notification) (*Notification, []*TargetError) {
+	if n.blocklist == nil {
+		return request, nil
+	}
+	var targets []string
+	var blocked []*TargetError
+	for _, target := range request.Targets() {
+		if n.IsTokenBlocked(request.Type, target) {
+			blocked = append(blocked, &TargetError{TargetIdentifier: target, Err: ErrTokenBlocked})
+			continue
+		}
+		targets = append(targets, target)
+	}
+	switch {
+	case len(blocked) == 0:
+		return request, nil
+	case len(targets) == 0:
+		return nil, blocked
+	default:
+		return request.forTargets(targets), blocked
+	}
+}
+
+// invalidateTokens blocks the targets the service reported invalid and
+// calls the token invalidated handlers.
+func (n *Notifier) invalidateTokens(ctx context.Context, serviceType string, request *Notification, err error) {
+	if err == nil || n.blocklist == nil && len(n.tokenHandlers) == 0 {
+		return
+	}
+	// The tokens are the ones of the type of the notification. A fallback
+	// rejecting them says nothing about their validity.
+	if serviceType != request.Type {
+		return
+	}
+	var failed []*TargetError
+	if merr, ok := err.(*MulticastError); ok {
+		failed = merr.Failed
+	} else if !request.isMulticast() {
+		failed = []*TargetError{{TargetIdentifier: request.TargetIdentifier, Err: err}}
+	}
+	for _, f := range failed {
+		if !IsInvalidToken(f.Err) || errors.Is(f.Err, ErrTokenBlocked) {
+			continue
+		}
+		if n.blocklist != nil {
+			if err := n.blocklist.BlockToken(serviceType, f.TargetIdentifier, f.Err.Error()); err != nil {
+				n.log(ctx).Error("failed to block token", "type", serviceType, "token", f.TargetIdentifier, "error", err)
+			}
+		}
+		invalid := &InvalidToken{
+			Type:             serviceType,
+			TargetIdentifier: f.TargetIdentifier,
+			Template:         request.Template,
+			Reason:           f.Err.Error(),
+			InvalidatedAt:    time.Now().UTC(),
+		}
+		for _, handler := range n.tokenHandlers {
+			handler(ctx, invalid)
+		}
+	}
+}
+
+// TokenInvalidatedWebhook returns a handler that POSTs the invalid token as
+// JSON to url in the background, so the sender of the notifications can
+// stop sending them.
+func TokenInvalidatedWebhook(url string, timeout time.Duration) TokenInvalidatedHandler {
+	client := &http.Client{Timeout: timeout}
+	return func(ctx context.Context, token *InvalidToken) {
+		logger := Logger(ctx)
+		body, err := json.Marshal(token)
+		if err != nil {
+			logger.Error("failed to marshal invalid token", "error", err)
+			return
+		}
+		tenant := Tenant(ctx)
+		requestID := RequestID(ctx)
+		go func() {
+			req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+			if err != nil {
+				logger.Error("failed to create token invalidated webhook request", "error", err)
+				return
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tenant != "" {
+				req.Header.Set("X-Tenant-Id", tenant)
+			}
+			if requestID != "" {
+				req.Header.Set("X-Request-Id", requestID)
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				logger.Error("failed to call token invalidated webhook", "error", err)
+				return
+			}
+			res.Body.Close()
+			if res.StatusCode/100 != 2 {
+				logger.Error("token invalidated webhook failed", "status", res.Status)
+			}
+		}()
+	}
+}
@@ -0,0 +1,33 @@
+package notify
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the tracer of the notify package.
+const TracerName = "github.com/breez/notify/notify"
+
+// The span attributes of a notification.
+const (
+	AttributeDeliveryID = attribute.Key("notify.delivery_id")
+	AttributeTemplate   = attribute.Key("notify.template")
+	AttributeType       = attribute.Key("notify.type")
+	AttributeService    = attribute.Key("notify.service")
+	AttributeAttempt    = attribute.Key("notify.attempt")
+)
+
+func tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// EndSpan records err on the span, if any, and ends it.
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}